@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcicli "github.com/cometbft/cometbft/abci/client"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// Chain apps joining a running chain are configured with an activation height. They receive
+// InitChain at that height and see their own chain history starting at height 1, so the heights
+// of all calls on their connections are translated. Their app hash is part of the composite
+// app hash from the activation height on.
+
+// activeAt returns true if the chain app takes part in the block at the given height
+func (hdl *AbciHandler) activeAt(height int64) bool {
+	return hdl.joinedAt(height) && !hdl.sunsetAt(height)
+}
+
+// joinedAt returns true if the app hash of the chain app is part of the composite app hash at the given height
+func (hdl *AbciHandler) joinedAt(height int64) bool {
+	return height >= hdl.ActivationHeight
+}
+
+// lateJoining returns true if the chain app joined the chain after genesis
+func (hdl *AbciHandler) lateJoining() bool {
+	return hdl.ActivationHeight > 1
+}
+
+// appHeight translates a height of the multiplexer into the height of the chain app.
+// Heights the chain app was paused at are not counted.
+func (hdl *AbciHandler) appHeight(height int64) int64 {
+	if hdl.sparse != nil {
+		return hdl.sparse.appHeight(height)
+	}
+	height -= hdl.pausedBefore(height + 1)
+	if !hdl.lateJoining() {
+		return height
+	}
+	return height - hdl.ActivationHeight + 1
+}
+
+// muxHeight translates a height of the chain app into the height of the multiplexer
+func (hdl *AbciHandler) muxHeight(appHeight int64) int64 {
+	if hdl.lateJoining() {
+		appHeight += hdl.ActivationHeight - 1
+	}
+	return hdl.unpausedHeight(appHeight)
+}
+
+// lastHeight returns the last committed height of the chain app as height of the multiplexer.
+// A late joining chain app without state is at the height before its activation.
+func (hdl *AbciHandler) lastHeight(info *abcitypes.ResponseInfo) int64 {
+	if hdl.lateJoining() && info.LastBlockHeight == 0 {
+		return hdl.ActivationHeight - 1
+	}
+	return info.LastBlockHeight
+}
+
+// translateConnections wraps the connections of a chain app to translate the heights
+func (hdl *AbciHandler) translateConnections() {
+	for _, conn := range []*abcicli.Client{&hdl.client, &hdl.mempoolConn, &hdl.queryConn} {
+		if *conn != nil {
+			*conn = hdl.translateHeights(*conn)
+		}
+	}
+}
+
+// translateHeights wraps a client of a chain app to translate heights. Sparse chain apps map
+// their heights, the heights of other chain apps start at their activation and skip the heights
+// they were paused at.
+func (hdl *AbciHandler) translateHeights(client abcicli.Client) abcicli.Client {
+	if hdl.sparse != nil {
+		// heights of a sparse chain app start at its activation
+		return &sparseHeightClient{Client: client, heights: hdl.sparse}
+	}
+	return &heightOffsetClient{Client: client, hdlr: hdl}
+}
+
+// activeChainApps returns the sorted identifiers of the chain apps taking part in the block at the given height
+func (mux *CometMux) activeChainApps(height int64) []ChainAppIdentifier {
+	ids := []ChainAppIdentifier{}
+	for id, hdlr := range mux.clients {
+		if hdlr.activeAt(height) && !hdlr.pausedAt(height) {
+			ids = append(ids, id)
+		}
+	}
+	SortChainAppIDs(ids)
+	return ids
+}
+
+// activationRecord persists the InitChain response of a late joining chain app, so a retried
+// activation, e.g. after a discarded optimistic execution, does not initialize the chain app twice
+type activationRecord struct {
+	mtx  sync.Mutex
+	db   dbm.DB
+	key  []byte
+	resp *abcitypes.ResponseInitChain
+}
+
+func newActivationRecord(id ChainAppIdentifier, shadow bool) *activationRecord {
+	key := []byte("activation:")
+	if shadow {
+		key = []byte("activation:shadow:")
+	}
+	return &activationRecord{key: append(key, id[:]...)}
+}
+
+// Load attaches the record to the database and reads a recorded activation
+func (r *activationRecord) Load(db dbm.DB) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	value, err := db.Get(r.key)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		resp := &abcitypes.ResponseInitChain{}
+		if err := resp.Unmarshal(value); err != nil {
+			return fmt.Errorf("invalid activation: %v", err)
+		}
+		r.resp = resp
+	}
+	r.db = db
+	return nil
+}
+
+// Reset forgets the activation, so a chain app rebuilt from scratch is initialized again
+func (r *activationRecord) Reset() error {
+	if r == nil {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.resp = nil
+	if r.db == nil {
+		return nil
+	}
+	return r.db.DeleteSync(r.key)
+}
+
+// SetActivationStore records the activations of all late joining chain apps in the given database
+func (mux *CometMux) SetActivationStore(db dbm.DB) error {
+	handlers := []*AbciHandler{}
+	for _, hdlr := range mux.clients {
+		handlers = append(handlers, hdlr)
+	}
+	for _, shadow := range mux.shadows {
+		handlers = append(handlers, shadow.AbciHandler)
+	}
+	for _, hdlr := range handlers {
+		if hdlr.activation == nil {
+			continue
+		}
+		if err := hdlr.activation.Load(db); err != nil {
+			return fmt.Errorf("error loading activation of '%s': %v", hdlr.ChainID, err)
+		}
+	}
+	return nil
+}
+
+// activateChainApp sends InitChain to a late joining chain app at its activation height.
+// The chain app starts with the validators and consensus parameters of its own genesis.
+// A chain app activated before is not initialized again, the recorded response is returned.
+func activateChainApp(ctx context.Context, hdlr *AbciHandler, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseInitChain, error) {
+	chain := &abcitypes.RequestInitChain{
+		Time:          req.Time,
+		InitialHeight: 1,
+	}
+	record := hdlr.activation
+	if record == nil {
+		return hdlr.InitChain(ctx, chain)
+	}
+	record.mtx.Lock()
+	defer record.mtx.Unlock()
+	if record.resp != nil {
+		return record.resp, nil
+	}
+	resp, err := hdlr.InitChain(ctx, chain)
+	if err != nil {
+		return nil, err
+	}
+	if record.db != nil {
+		value, err := resp.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		if err := record.db.SetSync(record.key, value); err != nil {
+			return nil, fmt.Errorf("error recording activation: %v", err)
+		}
+	}
+	record.resp = resp
+	return resp, nil
+}
+
+// heightOffsetClient translates the heights of the multiplexer into the heights of a late
+// joining or paused chain app and back
+type heightOffsetClient struct {
+	abcicli.Client
+	hdlr *AbciHandler
+}
+
+func (c *heightOffsetClient) toApp(height int64) int64 {
+	if height == 0 {
+		return 0
+	}
+	return c.hdlr.appHeight(height)
+}
+
+func (c *heightOffsetClient) fromApp(height int64) int64 {
+	if height == 0 {
+		return 0
+	}
+	return c.hdlr.muxHeight(height)
+}
+
+func (c *heightOffsetClient) Info(ctx context.Context, req *abcitypes.RequestInfo) (*abcitypes.ResponseInfo, error) {
+	resp, err := c.Client.Info(ctx, req)
+	if err == nil {
+		resp.LastBlockHeight = c.fromApp(resp.LastBlockHeight)
+	}
+	return resp, err
+}
+
+func (c *heightOffsetClient) Query(ctx context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+	if isControlQuery(req.Path) {
+		return c.Client.Query(ctx, req)
+	}
+	if req.Height > 0 && c.hdlr.lateJoining() && req.Height < c.hdlr.ActivationHeight {
+		// the chain app has no state before its activation
+		return &abcitypes.ResponseQuery{
+			Code:      CodeQueryFailed,
+			Codespace: MegablocksCodespace,
+			Log:       fmt.Sprintf("no state of chain app at height %d before its activation at %d", req.Height, c.hdlr.ActivationHeight),
+		}, nil
+	}
+	appReq := *req
+	appReq.Height = c.toApp(req.Height)
+	resp, err := c.Client.Query(ctx, &appReq)
+	if err == nil {
+		resp.Height = c.fromApp(resp.Height)
+	}
+	return resp, err
+}
+
+func (c *heightOffsetClient) ProcessProposal(ctx context.Context, req *abcitypes.RequestProcessProposal) (*abcitypes.ResponseProcessProposal, error) {
+	appReq := *req
+	appReq.Height = c.toApp(req.Height)
+	return c.Client.ProcessProposal(ctx, &appReq)
+}
+
+func (c *heightOffsetClient) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+	appReq := *req
+	appReq.Height = c.toApp(req.Height)
+	return c.Client.FinalizeBlock(ctx, &appReq)
+}
+
+func (c *heightOffsetClient) Commit(ctx context.Context, req *abcitypes.RequestCommit) (*abcitypes.ResponseCommit, error) {
+	resp, err := c.Client.Commit(ctx, req)
+	if err == nil {
+		resp.RetainHeight = c.fromApp(resp.RetainHeight)
+	}
+	return resp, err
+}
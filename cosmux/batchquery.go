@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// QueryPathBatch is the ABCI query path to query several chain apps at one common height.
+// The query data is a JSON encoded list of BatchQueryEntry, the value of the response a
+// JSON encoded list of BatchQueryResult in the same order.
+const QueryPathBatch = "/megablocks/batch"
+
+// BatchQueryEntry is a single query of a batch
+type BatchQueryEntry struct {
+	ChainID string `json:"chain_id"`
+	Path    string `json:"path"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// BatchQueryResult is the response of a chain app on a batch entry
+type BatchQueryResult struct {
+	ChainID  string                   `json:"chain_id"`
+	Response *abcitypes.ResponseQuery `json:"response"`
+}
+
+// BatchQuery forwards all entries pinned to the requested or else the last committed height.
+// The batch fails if any chain app cannot serve the query at that height.
+func (mux *CometMux) BatchQuery(ctx context.Context, entries []BatchQueryEntry, height int64) ([]BatchQueryResult, int64, error) {
+	committed := mux.committedHeight.Load()
+	if height == 0 {
+		height = committed
+	}
+	if height == 0 {
+		return nil, 0, fmt.Errorf("no committed height available")
+	}
+	if height > committed {
+		return nil, 0, fmt.Errorf("height %d is not committed yet, latest=%d", height, committed)
+	}
+
+	handlers := make([]*AbciHandler, len(entries))
+	for idx, entry := range entries {
+		hdlr, err := mux.getHandlerFromChainId(entry.ChainID)
+		if err != nil {
+			return nil, 0, err
+		}
+		handlers[idx] = hdlr
+	}
+
+	results := make([]BatchQueryResult, len(entries))
+	errs := make([]error, len(entries))
+	wg := sync.WaitGroup{}
+	wg.Add(len(entries))
+	for idx, entry := range entries {
+		idx, entry := idx, entry
+		go func() {
+			defer wg.Done()
+			req := &abcitypes.RequestQuery{ChainId: entry.ChainID, Path: entry.Path, Data: entry.Data, Height: height}
+			response, err := handlers[idx].query().Query(ctx, req)
+			results[idx] = BatchQueryResult{ChainID: entry.ChainID, Response: response}
+			errs[idx] = err
+		}()
+	}
+	wg.Wait()
+
+	for idx, result := range results {
+		switch {
+		case errs[idx] != nil:
+			return nil, 0, fmt.Errorf("query on '%s' failed: %v", result.ChainID, errs[idx])
+		case result.Response.IsErr():
+			return nil, 0, fmt.Errorf("query on '%s' failed: %s", result.ChainID, result.Response.Log)
+		// apps leaving the height of the response unset are trusted to serve the requested height
+		case result.Response.Height != 0 && result.Response.Height != height:
+			return nil, 0, fmt.Errorf("'%s' cannot serve height %d, got %d", result.ChainID, height, result.Response.Height)
+		}
+	}
+	return results, height, nil
+}
+
+// batchQuery serves a batch query received via ABCI Query
+func (mux *CometMux) batchQuery(ctx context.Context, req *abcitypes.RequestQuery) *abcitypes.ResponseQuery {
+	entries := []BatchQueryEntry{}
+	if err := json.Unmarshal(req.Data, &entries); err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: fmt.Sprintf("invalid batch: %v", err)}
+	}
+	results, height, err := mux.BatchQuery(ctx, entries, req.Height)
+	if err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	value, err := json.Marshal(results)
+	if err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	return &abcitypes.ResponseQuery{Value: value, Height: height}
+}
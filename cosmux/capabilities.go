@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// Some features of the multiplexer call query paths which the chain apps have to implement.
+// On startup each chain app is asked for the query paths it implements, and the multiplexer
+// refuses to start with a feature enabled which a chain app does not support.
+
+// QueryPathCapabilities is the ABCI query path asking a chain app for the query paths of the
+// multiplexer it implements. The value of the response is a JSON list of query paths.
+// Chain apps which do not serve the path implement none.
+const QueryPathCapabilities = "/megablocks/capabilities"
+
+// requiredQueryPaths returns the query paths the chain app has to implement by enabled feature
+func (mux *CometMux) requiredQueryPaths(hdlr *AbciHandler) map[string][]string {
+	required := map[string][]string{}
+	if mux.cfg.TwoPhaseCommit {
+		required["two_phase_commit"] = []string{QueryPathPrepareCommit, QueryPathRollback}
+	}
+	if mux.cfg.OptimisticExecution {
+		required["optimistic_execution"] = []string{QueryPathRollback}
+	}
+	if mux.cfg.ExportDir != "" && hdlr.SunsetHeight > 0 {
+		required["export_dir"] = []string{QueryPathExport}
+	}
+	return required
+}
+
+// CheckCapabilities returns an error if an enabled feature needs a query path a chain app does not implement
+func (mux *CometMux) CheckCapabilities(ctx context.Context) error {
+	ids := mapKeys(mux.clients)
+	SortChainAppIDs(ids)
+	for _, id := range ids {
+		hdlr := mux.clients[id]
+		required := mux.requiredQueryPaths(hdlr)
+		if len(required) == 0 {
+			continue
+		}
+		implemented, err := mux.queryCapabilities(ctx, hdlr)
+		if err != nil {
+			return err
+		}
+		features := mapKeys(required)
+		sort.Strings(features)
+		for _, feature := range features {
+			for _, path := range required[feature] {
+				if !implemented[path] {
+					return fmt.Errorf("chain app '%s' does not implement the query path '%s' required by '%s'",
+						hdlr.ChainID, path, feature)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// queryCapabilities returns the query paths of the multiplexer the chain app implements
+func (mux *CometMux) queryCapabilities(ctx context.Context, hdlr *AbciHandler) (map[string]bool, error) {
+	resp, err := hdlr.query().Query(ctx, &abcitypes.RequestQuery{ChainId: hdlr.ChainID, Path: QueryPathCapabilities})
+	if err != nil {
+		return nil, fmt.Errorf("error querying capabilities of '%s': %v", hdlr.ChainID, err)
+	}
+	implemented := map[string]bool{}
+	if resp.IsErr() {
+		return implemented, nil
+	}
+	paths := []string{}
+	if err := json.Unmarshal(resp.Value, &paths); err != nil {
+		return nil, fmt.Errorf("invalid capabilities of '%s': %v", hdlr.ChainID, err)
+	}
+	for _, path := range paths {
+		implemented[path] = true
+	}
+	return implemented, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	ctypes "github.com/cometbft/cometbft/rpc/core/types"
+	sm "github.com/cometbft/cometbft/state"
+	comettypes "github.com/cometbft/cometbft/types"
+)
+
+// AppHashStore stores the app hash of each chain app per finalized height.
+// The composite app hash of a block does not allow to split it into the app hashes
+// of the chain apps, so they are recorded by the multiplexer.
+type AppHashStore struct {
+	db dbm.DB
+}
+
+// NewAppHashStore creates an app hash store on the given database
+func NewAppHashStore(db dbm.DB) *AppHashStore {
+	return &AppHashStore{db: db}
+}
+
+func appHashKey(height int64, id ChainAppIdentifier) []byte {
+	key := binary.BigEndian.AppendUint64([]byte("apphash:"), uint64(height))
+	return append(key, id[:]...)
+}
+
+// Save stores the app hashes of all chain apps at the given height
+func (s *AppHashStore) Save(height int64, appHashes map[ChainAppIdentifier][]byte) error {
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for id, hash := range appHashes {
+		if err := batch.Set(appHashKey(height, id), hash); err != nil {
+			return err
+		}
+	}
+	return batch.WriteSync()
+}
+
+// Load returns the app hash of a chain app at the given height
+func (s *AppHashStore) Load(height int64, id ChainAppIdentifier) ([]byte, error) {
+	hash, err := s.db.Get(appHashKey(height, id))
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		return nil, fmt.Errorf("no app hash of chain app %v stored at height %d", id, height)
+	}
+	return hash, nil
+}
+
+// ChainViews reconstructs the blocks and block results of a single chain app
+// from the CometBFT block and state store
+type ChainViews struct {
+	mux        *CometMux
+	blockStore sm.BlockStore
+	stateStore sm.Store
+}
+
+// NewChainViews creates the per-chain views on the stores of a CometBFT node
+func NewChainViews(mux *CometMux, blockStore sm.BlockStore, stateStore sm.Store) *ChainViews {
+	return &ChainViews{
+		mux:        mux,
+		blockStore: blockStore,
+		stateStore: stateStore,
+	}
+}
+
+// resolveHeight returns the latest height if none is given
+func (v *ChainViews) resolveHeight(height *int64) (int64, error) {
+	latest := v.blockStore.Height()
+	if height == nil || *height == 0 {
+		return latest, nil
+	}
+	if *height < v.blockStore.Base() || *height > latest {
+		return 0, fmt.Errorf("height %d is not available, base=%d, latest=%d", *height, v.blockStore.Base(), latest)
+	}
+	return *height, nil
+}
+
+// Block returns the block at the given height with only the stripped transactions
+// of the chain app and its own app hash in the header. The block ID remains the one
+// of the Megablocks block.
+func (v *ChainViews) Block(hdlr *AbciHandler, height *int64) (*ctypes.ResultBlock, error) {
+	h, err := v.resolveHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	block := v.blockStore.LoadBlock(h)
+	meta := v.blockStore.LoadBlockMeta(h)
+	if block == nil || meta == nil {
+		return nil, fmt.Errorf("block at height %d not found", h)
+	}
+
+	chainBlock := v.mux.chainBlock(hdlr, block)
+
+	// header contains the app hash resulting from the previous block or InitChain
+	if chainBlock.Header.AppHash, err = v.appHash(h-1, hdlr.ID); err != nil {
+		return nil, err
+	}
+	return &ctypes.ResultBlock{BlockID: meta.BlockID, Block: chainBlock}, nil
+}
+
+// BlockResults returns the results of the chain app's transactions and its events
+// and app hash at the given height
+func (v *ChainViews) BlockResults(hdlr *AbciHandler, height *int64) (*ctypes.ResultBlockResults, error) {
+	h, err := v.resolveHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	block := v.blockStore.LoadBlock(h)
+	if block == nil {
+		return nil, fmt.Errorf("block at height %d not found", h)
+	}
+	results, err := v.stateStore.LoadFinalizeBlockResponse(h)
+	if err != nil {
+		return nil, err
+	}
+	appHash, err := v.appHash(h, hdlr.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctypes.ResultBlockResults{
+		Height:                h,
+		TxsResults:            v.mux.chainTxResults(hdlr, block.Txs, results.TxResults),
+		FinalizeBlockEvents:   chainEvents(hdlr, results.Events),
+		ConsensusParamUpdates: results.ConsensusParamUpdates,
+		AppHash:               appHash,
+	}, nil
+}
+
+func (v *ChainViews) appHash(height int64, id ChainAppIdentifier) ([]byte, error) {
+	if v.mux.appHashStore == nil {
+		return nil, fmt.Errorf("app hash store not enabled")
+	}
+	return v.mux.appHashStore.Load(height, id)
+}
+
+// isChainTx returns true if tx is routed to the given chain app
+func (mux *CometMux) isChainTx(hdlr *AbciHandler, tx []byte) bool {
+	txHdlr, err := mux.getHandler(tx)
+	return err == nil && txHdlr.ID == hdlr.ID
+}
+
+// chainBlock returns a copy of the block with only the stripped transactions of the chain app
+func (mux *CometMux) chainBlock(hdlr *AbciHandler, block *comettypes.Block) *comettypes.Block {
+	chainBlock := &comettypes.Block{
+		Header:     block.Header,
+		Data:       comettypes.Data{Txs: comettypes.Txs{}},
+		Evidence:   block.Evidence,
+		LastCommit: block.LastCommit,
+	}
+	for _, tx := range block.Txs {
+		if mux.isChainTx(hdlr, tx) {
+			chainBlock.Data.Txs = append(chainBlock.Data.Txs, StripHeader(tx))
+		}
+	}
+	return chainBlock
+}
+
+// chainTxResults returns the results of the chain app's transactions in a block
+func (mux *CometMux) chainTxResults(hdlr *AbciHandler, txs comettypes.Txs, results []*abcitypes.ExecTxResult) []*abcitypes.ExecTxResult {
+	chainResults := []*abcitypes.ExecTxResult{}
+	for idx, tx := range txs {
+		if mux.isChainTx(hdlr, tx) && idx < len(results) {
+			chainResults = append(chainResults, results[idx])
+		}
+	}
+	return chainResults
+}
+
+// chainEvents returns the block events tagged with the given chain app
+func chainEvents(hdlr *AbciHandler, events []abcitypes.Event) []abcitypes.Event {
+	filtered := []abcitypes.Event{}
+	for _, event := range events {
+		if chainID, tagged := eventChainID(event); tagged && chainID == hdlr.ChainID {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+var (
+	// CondMAGIC marks a conditional Megablocks transaction. A conditional transaction is only
+	// forwarded to its chain app if the referenced transaction of the same block succeeded.
+	CondMAGIC = [...]byte{0x23, 0x6d, 0x75, 0x63}
+	// CondMAGIC + 4byte-hash of ChainID + 4byte index of the referenced tx in the block
+	DependencyRefLen     = 4
+	CondHeaderLen    int = MbHeaderLen + DependencyRefLen
+)
+
+// Codespace and codes of ExecTxResults created by the multiplexer itself
+const (
+	MegablocksCodespace = "megablocks"
+
+	CodeDependencyFailed uint32 = 1
+	CodeQueryFailed      uint32 = 2
+	CodeChainAppInactive uint32 = 3
+	CodeChainAppPaused   uint32 = 4
+	CodeInvalidControlTx uint32 = 5
+	CodeReservedPayload  uint32 = 6
+)
+
+// IsConditionalTx returns true if tx carries a conditional Megablocks header
+func IsConditionalTx(tx []byte) bool {
+	return len(tx) >= CondHeaderLen && bytes.Equal(tx[:len(CondMAGIC)], CondMAGIC[:])
+}
+
+// HeaderLength returns the length of the Megablocks header of tx
+func HeaderLength(tx []byte) int {
+	if IsConditionalTx(tx) {
+		return CondHeaderLen
+	}
+	return MbHeaderLen
+}
+
+// StripHeader returns the transaction as expected by the chain app
+func StripHeader(tx []byte) []byte {
+	return tx[HeaderLength(tx):]
+}
+
+// DependencyIndex returns the index of the transaction a conditional transaction depends on.
+// For non conditional transactions -1 is returned.
+func DependencyIndex(tx []byte) int {
+	if !IsConditionalTx(tx) {
+		return -1
+	}
+	return int(binary.BigEndian.Uint32(tx[MbHeaderLen:CondHeaderLen]))
+}
+
+// CreateConditionalHeader creates the Megablocks header of a transaction for the
+// chain app 'appID' which is only executed if the tx at 'dependsOn' in the same block succeeds
+func CreateConditionalHeader(appID ChainAppIdentifier, dependsOn uint32) []byte {
+	header := append([]byte{}, CondMAGIC[:]...)
+	header = append(header, appID[:]...)
+	return binary.BigEndian.AppendUint32(header, dependsOn)
+}
+
+// dependencyFailedResult is the result of a conditional transaction which was not forwarded
+// to its chain app as the referenced transaction did not succeed
+func dependencyFailedResult(dependsOn int) *abcitypes.ExecTxResult {
+	return &abcitypes.ExecTxResult{
+		Code:      CodeDependencyFailed,
+		Codespace: MegablocksCodespace,
+		Log:       fmt.Sprintf("dependency failed: referenced tx %d did not succeed", dependsOn),
+	}
+}
+
+// checkDependency verifies that the conditional transaction at index 'idx' references
+// a valid transaction. A valid reference points to a non conditional transaction of
+// another chain app in the same block.
+func checkDependency(txs [][]byte, idx int) error {
+	dep := DependencyIndex(txs[idx])
+	if dep < 0 {
+		return nil
+	}
+	if dep >= len(txs) || dep == idx {
+		return fmt.Errorf("invalid dependency of tx %d: index %d out of range", idx, dep)
+	}
+	if CheckHeader(txs[dep]) != nil || IsConditionalTx(txs[dep]) {
+		return fmt.Errorf("invalid dependency of tx %d: tx %d is not a plain Megablocks tx", idx, dep)
+	}
+	if bytes.Equal(txs[idx][len(CondMAGIC):MbHeaderLen], txs[dep][len(MAGIC):MbHeaderLen]) {
+		return fmt.Errorf("invalid dependency of tx %d: tx %d belongs to the same chain app", idx, dep)
+	}
+	return nil
+}
+
+// executionWaves groups the chain apps of a block into waves which can be executed in parallel.
+// An app is scheduled after all apps it has conditional transactions on.
+// Apps with cyclic dependencies are scheduled in a final wave where their
+// unresolved conditional transactions fail.
+func executionWaves(ids []ChainAppIdentifier, txs [][]byte) (waves [][]ChainAppIdentifier, cyclic bool) {
+	dependsOn := map[ChainAppIdentifier]map[ChainAppIdentifier]bool{}
+	for idx, tx := range txs {
+		if checkDependency(txs, idx) != nil || !IsConditionalTx(tx) {
+			continue
+		}
+		appID := ChainAppIdentifier(tx[len(CondMAGIC):MbHeaderLen])
+		depTx := txs[DependencyIndex(tx)]
+		if dependsOn[appID] == nil {
+			dependsOn[appID] = map[ChainAppIdentifier]bool{}
+		}
+		dependsOn[appID][ChainAppIdentifier(depTx[len(MAGIC):MbHeaderLen])] = true
+	}
+
+	pending := append([]ChainAppIdentifier{}, ids...)
+	SortChainAppIDs(pending)
+	for len(pending) > 0 {
+		wave := []ChainAppIdentifier{}
+		remaining := []ChainAppIdentifier{}
+		for _, id := range pending {
+			ready := true
+			for dep := range dependsOn[id] {
+				if contains(pending, dep) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, id)
+			} else {
+				remaining = append(remaining, id)
+			}
+		}
+		if len(wave) == 0 {
+			// dependency cycle: execute all remaining apps at once
+			return append(waves, remaining), true
+		}
+		waves = append(waves, wave)
+		pending = remaining
+	}
+	return waves, false
+}
+
+func contains(ids []ChainAppIdentifier, id ChainAppIdentifier) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func mapKeys[K comparable, T any](m map[K]T) []K {
+	keys := []K{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
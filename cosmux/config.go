@@ -9,8 +9,39 @@ import (
 )
 
 type CosmuxConfig struct {
-	Apps     []MegaBlockApp `mapstructure:"apps"`
-	LogLevel string         `mapstructure:"log_level"`
+	Apps       []MegaBlockApp   `mapstructure:"apps"`
+	LogLevel   string           `mapstructure:"log_level"`
+	CrossQuery CrossQueryConfig `mapstructure:"cross_query"`
+	RPCProxy   RPCProxyConfig   `mapstructure:"rpc_proxy"`
+	// local client mode between CometBFT and the multiplexer ('conn_sync' or 'concurrent')
+	ClientMode string `mapstructure:"client_mode"`
+	// start FinalizeBlock of the chain apps as soon as a proposal is accepted
+	OptimisticExecution bool `mapstructure:"optimistic_execution"`
+	// answer rechecks of chain apps which did not receive the last block from the earlier CheckTx result
+	SkipUnchangedRechecks bool `mapstructure:"skip_unchanged_rechecks"`
+	// prepare all chain apps before Commit and roll them back if any fails to commit,
+	// requires the chain apps to serve the two-phase commit query paths
+	TwoPhaseCommit bool `mapstructure:"two_phase_commit"`
+	// number of calls a shadow chain app may lag behind its primary before it is stopped
+	ShadowQueueSize int `mapstructure:"shadow_queue_size"`
+	// directory the state of retired chain apps is exported to, defaults to the data directory
+	ExportDir string `mapstructure:"export_dir"`
+}
+
+// RPCProxyConfig configures the proxy serving the CometBFT RPC per chain app
+type RPCProxyConfig struct {
+	// listen address of the proxy, the proxy is disabled if empty
+	Address string `mapstructure:"address"`
+}
+
+// CrossQueryConfig configures the service for queries of chain apps on their siblings
+type CrossQueryConfig struct {
+	// listen address of the service, the service is disabled if empty
+	Address string `mapstructure:"address"`
+	// size budget of a single response, the outcome is the same on every node
+	MaxResponseBytes int `mapstructure:"max_response_bytes"`
+	// gas budget of each calling chain app per height, calls are charged for the bytes they move
+	MaxGasPerBlock uint64 `mapstructure:"max_gas_per_block"`
 }
 
 func (cfg *CosmuxConfig) ValidateBasic() error {
@@ -42,8 +73,16 @@ func DefaultApps() []MegaBlockApp {
 // DefaultConfig returns a default configuration for a CometBFT node
 func DefaultConfig() *CosmuxConfig {
 	return &CosmuxConfig{
-		LogLevel: "info",
-		Apps:     DefaultApps(),
+		LogLevel:   "info",
+		Apps:       DefaultApps(),
+		ClientMode: ClientModeConnSync,
+		// calls a shadow may lag behind
+		ShadowQueueSize: defaultShadowQueueSize,
+
+		CrossQuery: CrossQueryConfig{
+			MaxResponseBytes: 1 << 20,
+			MaxGasPerBlock:   1 << 24,
+		},
 	}
 }
 
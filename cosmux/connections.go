@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	abcicli "github.com/cometbft/cometbft/abci/client"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/proxy"
+)
+
+// Each chain app gets dedicated connections like a CometBFT node uses towards an application,
+// so queries and CheckTx do not block block execution on the consensus connection.
+// Connections not set fall back to the consensus connection. No snapshot connection is
+// opened as long as state sync is answered by the multiplexer and not forwarded to the chain apps.
+
+// connectChainApp creates the consensus, mempool and query connections of a chain app
+func connectChainApp(hdlr *AbciHandler, address, transport string) error {
+	creator := proxy.NewRemoteClientCreator(address, transport, true)
+	for _, conn := range []*abcicli.Client{&hdlr.client, &hdlr.mempoolConn, &hdlr.queryConn} {
+		client, err := creator.NewABCIClient()
+		if err != nil {
+			return err
+		}
+		*conn = client
+	}
+	return nil
+}
+
+// connections returns the distinct connections of the chain app by name
+func (hdl *AbciHandler) connections() map[string]abcicli.Client {
+	conns := map[string]abcicli.Client{"consensus": hdl.client}
+	for name, conn := range map[string]abcicli.Client{
+		"mempool": hdl.mempoolConn,
+		"query":   hdl.queryConn,
+	} {
+		if conn != nil {
+			conns[name] = conn
+		}
+	}
+	return conns
+}
+
+// consensus returns the connection for InitChain, block execution and Commit
+func (hdl *AbciHandler) consensus() abcicli.Client {
+	return &lockedClient{Client: hdl.client, mtx: &hdl.consensusMtx, retired: &hdl.retired}
+}
+
+// mempool returns the connection for CheckTx
+func (hdl *AbciHandler) mempool() abcicli.Client {
+	conn := hdl.mempoolConn
+	if conn == nil {
+		conn = hdl.client
+	}
+	return &lockedClient{Client: conn, mtx: &hdl.mempoolMtx, retired: &hdl.retired}
+}
+
+// query returns the connection for Info and Query
+func (hdl *AbciHandler) query() abcicli.Client {
+	conn := hdl.queryConn
+	if conn == nil {
+		conn = hdl.client
+	}
+	return &lockedClient{Client: conn, mtx: &hdl.queryMtx, retired: &hdl.retired}
+}
+
+// closeConnections closes the connections of a chain app once all running calls returned
+func (hdl *AbciHandler) closeConnections() error {
+	for _, mtx := range []*sync.Mutex{&hdl.consensusMtx, &hdl.mempoolMtx, &hdl.queryMtx} {
+		mtx.Lock()
+		defer mtx.Unlock()
+	}
+	hdl.retired.Store(true)
+	for name, conn := range hdl.connections() {
+		if !conn.IsRunning() {
+			continue
+		}
+		if err := conn.Stop(); err != nil {
+			return fmt.Errorf("error closing %s connection: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// lockedClient serializes the calls forwarded by the multiplexer on a connection of a chain app.
+// With the concurrent local client CometBFT calls the multiplexer concurrently, so calls for
+// different chain apps or connections proceed in parallel while each connection of a chain app
+// still sees its calls in order. Calls on the closed connections of a retired chain app fail.
+type lockedClient struct {
+	abcicli.Client
+	mtx     *sync.Mutex
+	retired *atomic.Bool
+}
+
+// errChainAppRetired is returned for calls on the connections of a retired chain app
+var errChainAppRetired = errors.New("chain app is retired, its connections are closed")
+
+func (c *lockedClient) Info(ctx context.Context, req *abcitypes.RequestInfo) (*abcitypes.ResponseInfo, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.Info(ctx, req)
+}
+
+func (c *lockedClient) Query(ctx context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.Query(ctx, req)
+}
+
+func (c *lockedClient) CheckTx(ctx context.Context, req *abcitypes.RequestCheckTx) (*abcitypes.ResponseCheckTx, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.CheckTx(ctx, req)
+}
+
+func (c *lockedClient) InitChain(ctx context.Context, req *abcitypes.RequestInitChain) (*abcitypes.ResponseInitChain, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.InitChain(ctx, req)
+}
+
+func (c *lockedClient) ProcessProposal(ctx context.Context, req *abcitypes.RequestProcessProposal) (*abcitypes.ResponseProcessProposal, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.ProcessProposal(ctx, req)
+}
+
+func (c *lockedClient) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.FinalizeBlock(ctx, req)
+}
+
+func (c *lockedClient) Commit(ctx context.Context, req *abcitypes.RequestCommit) (*abcitypes.ResponseCommit, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.retired.Load() {
+		return nil, errChainAppRetired
+	}
+	return c.Client.Commit(ctx, req)
+}
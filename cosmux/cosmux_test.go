@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	dbm "github.com/cometbft/cometbft-db"
 	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
 	"github.com/cometbft/cometbft/proto/tendermint/crypto"
 	"github.com/cometbft/cometbft/proto/tendermint/types"
+	sm "github.com/cometbft/cometbft/state"
 	comettypes "github.com/cometbft/cometbft/types"
+	"github.com/go-kit/kit/metrics"
 	gomock "github.com/golang/mock/gomock"
 	"github.com/informalsystems/megablocks/testutil/mocks"
 )
@@ -23,8 +36,7 @@ func generateTxApp(chainID string, data []byte) []byte {
 }
 
 func getChainAppIdentifier(chainID string) ChainAppIdentifier {
-	sha1Sum := sha1.Sum([]byte(chainID))
-	return ChainAppIdentifier(sha1Sum[:5])
+	return GetChainAppIdentifier(chainID)
 }
 
 func createHeader(chainId string) []byte {
@@ -48,6 +60,11 @@ func TestCheckHeader(t *testing.T) {
 			Header:          append(MAGIC[:], 0x01, 0x02, 0x03, 0x04),
 			ExpectedFailure: false,
 		},
+		{
+			Name:            "ChainAppHeader",
+			Header:          createHeader("chainA"),
+			ExpectedFailure: false,
+		},
 		{
 			Name:            "HeaderTooShort",
 			Header:          append(MAGIC[:], 0x01, 0x02, 0x03),
@@ -434,30 +451,30 @@ func TestFinalizeBock(t *testing.T) {
 			},
 			ExpectedResponse: abcitypes.ResponseFinalizeBlock{
 				Events: []abcitypes.Event{
-					{
+					withChainTags("anotherChain", abcitypes.Event{
 						Type:       "anotherChain-Attr1",
 						Attributes: []abcitypes.EventAttribute{{Key: "x1", Value: "y1"}},
-					},
-					{
+					}),
+					withChainTags("myChain", abcitypes.Event{
 						Type:       "myChain-Attr1",
 						Attributes: []abcitypes.EventAttribute{{Key: "k1", Value: "val1"}},
-					},
-					{
+					}),
+					withChainTags("myChain", abcitypes.Event{
 						Type:       "myChain-Attr2",
 						Attributes: []abcitypes.EventAttribute{{Key: "k2", Value: "val2"}},
-					},
+					}),
 				},
 				TxResults: []*abcitypes.ExecTxResult{
-					{Info: "myChain", GasWanted: 11, GasUsed: 11},
-					{Info: "anotherChain", GasWanted: 21, GasUsed: 21},
-					{Info: "anotherChain", GasWanted: 22, GasUsed: 22},
-					{Info: "myChain", GasWanted: 12, GasUsed: 12},
-					{Info: "myChain", GasWanted: 13, GasUsed: 13},
-					{Info: "myChain", GasWanted: 14, GasUsed: 14},
-					{Info: "anotherChain", GasWanted: 23, GasUsed: 23},
-					{Info: "myChain", GasWanted: 15, GasUsed: 15},
-					{Info: "anotherChain", GasWanted: 24, GasUsed: 24},
-					{Info: "anotherChain", GasWanted: 25, GasUsed: 25},
+					expectedTxResult("myChain", 11),
+					expectedTxResult("anotherChain", 21),
+					expectedTxResult("anotherChain", 22),
+					expectedTxResult("myChain", 12),
+					expectedTxResult("myChain", 13),
+					expectedTxResult("myChain", 14),
+					expectedTxResult("anotherChain", 23),
+					expectedTxResult("myChain", 15),
+					expectedTxResult("anotherChain", 24),
+					expectedTxResult("anotherChain", 25),
 				},
 				ValidatorUpdates: []abcitypes.ValidatorUpdate{
 					{PubKey: crypto.PublicKey{Sum: &crypto.PublicKey_Ed25519{Ed25519: []byte{6, 7, 8}}}, Power: 70},
@@ -543,30 +560,30 @@ func TestFinalizeBock(t *testing.T) {
 			},
 			ExpectedResponse: abcitypes.ResponseFinalizeBlock{
 				Events: []abcitypes.Event{
-					{
+					withChainTags("anotherChain", abcitypes.Event{
 						Type:       "anotherChain-Attr1",
 						Attributes: []abcitypes.EventAttribute{{Key: "x1", Value: "y1"}},
-					},
-					{
+					}),
+					withChainTags("myChain", abcitypes.Event{
 						Type:       "myChain-Attr1",
 						Attributes: []abcitypes.EventAttribute{{Key: "k1", Value: "val1"}},
-					},
-					{
+					}),
+					withChainTags("myChain", abcitypes.Event{
 						Type:       "myChain-Attr2",
 						Attributes: []abcitypes.EventAttribute{{Key: "k2", Value: "val2"}},
-					},
+					}),
 				},
 				TxResults: []*abcitypes.ExecTxResult{
-					{Info: "myChain", GasWanted: 11, GasUsed: 11},
-					{Info: "anotherChain", GasWanted: 21, GasUsed: 21},
-					{Info: "anotherChain", GasWanted: 22, GasUsed: 22},
-					{Info: "myChain", GasWanted: 12, GasUsed: 12},
-					{Info: "myChain", GasWanted: 13, GasUsed: 13},
-					{Info: "myChain", GasWanted: 14, GasUsed: 14},
-					{Info: "anotherChain", GasWanted: 23, GasUsed: 23},
-					{Info: "myChain", GasWanted: 15, GasUsed: 15},
-					{Info: "anotherChain", GasWanted: 24, GasUsed: 24},
-					{Info: "anotherChain", GasWanted: 25, GasUsed: 25},
+					expectedTxResult("myChain", 11),
+					expectedTxResult("anotherChain", 21),
+					expectedTxResult("anotherChain", 22),
+					expectedTxResult("myChain", 12),
+					expectedTxResult("myChain", 13),
+					expectedTxResult("myChain", 14),
+					expectedTxResult("anotherChain", 23),
+					expectedTxResult("myChain", 15),
+					expectedTxResult("anotherChain", 24),
+					expectedTxResult("anotherChain", 25),
 				},
 				ValidatorUpdates: []abcitypes.ValidatorUpdate{
 					{PubKey: crypto.PublicKey{Sum: &crypto.PublicKey_Ed25519{Ed25519: []byte{6, 7, 8}}}, Power: 70},
@@ -652,3 +669,1925 @@ func TestFinalizeBock(t *testing.T) {
 
 	}
 }
+
+func TestConditionalTransactions(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	condHeader := func(chainID string, dependsOn uint32) []byte {
+		return CreateConditionalHeader(getChainAppIdentifier(chainID), dependsOn)
+	}
+
+	txs := [][]byte{
+		append(createHeader("chainA"), 0xa0), // fails
+		append(createHeader("chainA"), 0xa1), // succeeds
+		append(condHeader("chainB", 0), 0xb0),
+		append(condHeader("chainB", 1), 0xb1),
+		append(createHeader("chainB"), 0xb2),
+	}
+
+	var chainBTxs [][]byte
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{
+		TxResults: []*abcitypes.ExecTxResult{{Code: 5}, {Code: 0}},
+		AppHash:   []byte{0xaa},
+	}, nil).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			chainBTxs = req.Txs
+			return &abcitypes.ResponseFinalizeBlock{
+				TxResults: []*abcitypes.ExecTxResult{{Info: "b1"}, {Info: "b2"}},
+				AppHash:   []byte{0xbb},
+			}, nil
+		}).Times(1)
+
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		getChainAppIdentifier("chainA"): {ChainID: "chainA", ID: getChainAppIdentifier("chainA"), client: clientA},
+		getChainAppIdentifier("chainB"): {ChainID: "chainB", ID: getChainAppIdentifier("chainB"), client: clientB},
+	}
+
+	response, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Txs: txs})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(chainBTxs, [][]byte{{0xb1}, {0xb2}}) {
+		t.Errorf("unexpected txs forwarded to chainB: %v", chainBTxs)
+	}
+	if response.TxResults[2].Code != CodeDependencyFailed || response.TxResults[2].Codespace != MegablocksCodespace {
+		t.Errorf("expected dependency failure for tx 2, got %+v", response.TxResults[2])
+	}
+	if response.TxResults[3].Info != "b1" || response.TxResults[4].Info != "b2" {
+		t.Errorf("unexpected results for chainB: %+v, %+v", response.TxResults[3], response.TxResults[4])
+	}
+
+	// proposals with invalid references are rejected
+	invalid := [][]byte{
+		append(createHeader("chainA"), 0xa0),
+		append(condHeader("chainA", 0), 0xa1),
+	}
+	resp, err := cosmux.ProcessProposal(context.Background(), &abcitypes.RequestProcessProposal{Txs: invalid})
+	if err != nil || resp.Status != abcitypes.ResponseProcessProposal_REJECT {
+		t.Errorf("expected rejection of proposal with invalid dependency: resp=%v, err=%v", resp, err)
+	}
+}
+
+func TestCrossQuery(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", CrossQuery: CrossQueryConfig{MaxResponseBytes: 4, MaxGasPerBlock: 3 * crossQueryBaseGas}},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockclient := mocks.NewMockClient(mockCtrl)
+	mockclient.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			return &abcitypes.ResponseQuery{Value: req.Data, Height: req.Height}, nil
+		}).AnyTimes()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		getChainAppIdentifier("chainA"): {ChainID: "chainA", ID: getChainAppIdentifier("chainA"), client: mockclient},
+	}
+	svc := NewCrossQueryService(cosmux)
+	ctx := context.Background()
+
+	// no committed state yet
+	if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{ChainID: "chainA", Path: "/key"}); err == nil {
+		t.Errorf("expected cross query to fail without committed height")
+	}
+
+	cosmux.committedHeight.Store(7)
+	resp, err := svc.CrossQuery(ctx, &CrossQueryRequest{ChainID: "chainA", Path: "/key", Data: []byte{1}})
+	if err != nil {
+		t.Fatalf("cross query failed: %v", err)
+	}
+	if resp.Height != 7 {
+		t.Errorf("cross query not pinned to committed height: got=%d, want=7", resp.Height)
+	}
+
+	// response exceeding the budget
+	if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{ChainID: "chainA", Data: []byte{1, 2, 3, 4, 5}}); err == nil {
+		t.Errorf("expected cross query exceeding budget to fail")
+	}
+
+	// queries on the calling chain app itself
+	if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{Caller: "chainA", ChainID: "chainA"}); err == nil {
+		t.Errorf("expected cross query on the caller to fail")
+	}
+
+	// the gas budget of a caller is used up within a height and renewed at the next one
+	for i := 0; i < 2; i++ {
+		if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{Caller: "chainB", ChainID: "chainA"}); err != nil {
+			t.Fatalf("cross query within gas budget failed: %v", err)
+		}
+	}
+	if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{Caller: "chainB", ChainID: "chainA", Data: []byte{1}}); err == nil {
+		t.Errorf("expected cross query exceeding the gas budget to fail")
+	}
+	if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{Caller: "chainC", ChainID: "chainA"}); err != nil {
+		t.Errorf("expected gas budget per caller: %v", err)
+	}
+	cosmux.committedHeight.Store(8)
+	if _, err := svc.CrossQuery(ctx, &CrossQueryRequest{Caller: "chainB", ChainID: "chainA"}); err != nil {
+		t.Errorf("expected gas budget to be renewed at the next height: %v", err)
+	}
+}
+
+func TestSiblingHashes(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	var received [][]byte
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			received = req.Txs
+			return &abcitypes.ResponseFinalizeBlock{
+				TxResults: []*abcitypes.ExecTxResult{{Info: "system"}, {Info: "a0"}},
+				AppHash:   []byte{0xa2},
+			}, nil
+		}).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xb2}}, nil).Times(1)
+
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA, SiblingHashes: true},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+	cosmux.appHashes = map[ChainAppIdentifier][]byte{idA: {0xa1}, idB: {0xb1}}
+
+	response, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{
+		Height: 2,
+		Txs:    [][]byte{append(createHeader("chainA"), 0xa0)},
+	})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+
+	if len(received) != 2 || !IsSystemTx(received[0]) {
+		t.Fatalf("expected system tx as first tx, got: %v", received)
+	}
+	info := SiblingInfo{}
+	if err := json.Unmarshal(received[0][len(SysMAGIC):], &info); err != nil {
+		t.Fatalf("error decoding sibling info: %v", err)
+	}
+	if info.Height != 1 || len(info.Apps) != 2 {
+		t.Errorf("unexpected sibling info: %+v", info)
+	}
+	for _, app := range info.Apps {
+		if app.ChainID == "chainB" && !bytes.Equal(app.AppHash, []byte{0xb1}) {
+			t.Errorf("unexpected app hash for chainB: %v", app.AppHash)
+		}
+	}
+	if len(response.TxResults) != 1 || response.TxResults[0].Info != "a0" {
+		t.Errorf("unexpected tx results: %v", response.TxResults)
+	}
+	if !bytes.Equal(cosmux.appHashes[idB], []byte{0xb2}) {
+		t.Errorf("app hashes not updated: %v", cosmux.appHashes)
+	}
+}
+
+func TestForgedSiblingHashes(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, SiblingHashes: true},
+		idB: {ChainID: "chainB", ID: idB},
+	}
+	forgedA := append(createHeader("chainA"), append(SysMAGIC[:], []byte(`{"height":1}`)...)...)
+	forgedB := append(createHeader("chainB"), SysMAGIC[:]...)
+
+	// user transactions must not look like system transactions to apps with sibling hashes
+	check, err := cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: forgedA})
+	if err != nil || check.Code != CodeReservedPayload {
+		t.Errorf("expected forged system tx to be rejected: %v, %v", check, err)
+	}
+	proposal, err := cosmux.ProcessProposal(context.Background(), &abcitypes.RequestProcessProposal{Height: 1, Txs: [][]byte{forgedA}})
+	if err != nil || proposal.Status != abcitypes.ResponseProcessProposal_REJECT {
+		t.Errorf("expected proposal with forged system tx to be rejected: %v, %v", proposal, err)
+	}
+	prepared, err := cosmux.PrepareProposal(context.Background(), &abcitypes.RequestPrepareProposal{Height: 1, Txs: [][]byte{forgedA, forgedB}})
+	if err != nil || len(prepared.Txs) != 1 || !bytes.Equal(prepared.Txs[0], forgedB) {
+		t.Errorf("expected forged system tx to be left out: %v, %v", prepared, err)
+	}
+}
+
+func TestTagEvents(t *testing.T) {
+	hdlrA := &AbciHandler{ChainID: "chainA", ID: getChainAppIdentifier("chainA")}
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: getChainAppIdentifier("chainB")}
+
+	// events of the reserved type and reserved attributes emitted by a chain app are removed
+	events := []abcitypes.Event{
+		chainEvent(hdlrB),
+		{Type: "transfer", Attributes: append([]abcitypes.EventAttribute{{Key: "amount", Value: "1"}}, chainAttributes(hdlrB)...)},
+	}
+	tagged := tagEvents(events, hdlrA)
+	if len(tagged) != 1 || len(tagged[0].Attributes) != 3 || tagged[0].Attributes[0].Key != "amount" {
+		t.Fatalf("unexpected tagged events: %v", tagged)
+	}
+	if chainID, ok := eventChainID(tagged[0]); !ok || chainID != "chainA" {
+		t.Errorf("unexpected chain of tagged event: %s", chainID)
+	}
+	if len(chainEvents(hdlrB, tagged)) != 0 || len(chainEvents(hdlrA, tagged)) != 1 {
+		t.Errorf("events of chainA attributed to chainB")
+	}
+	// the events of the chain app are not modified
+	if len(events[1].Attributes) != 3 || events[1].Attributes[1].Value != "chainB" {
+		t.Errorf("events of the chain app modified: %v", events)
+	}
+
+	result := tagTxResult(&abcitypes.ExecTxResult{Events: events}, hdlrA)
+	if len(result.Events) != 2 || result.Events[0].Type != "transfer" || len(result.Events[0].Attributes) != 1 ||
+		!reflect.DeepEqual(result.Events[1], chainEvent(hdlrA)) {
+		t.Errorf("unexpected tagged tx result: %v", result.Events)
+	}
+}
+
+// withChainTags adds the attributes of the originating chain app to an expected block event
+func withChainTags(chainID string, event abcitypes.Event) abcitypes.Event {
+	event.Attributes = append(event.Attributes, chainAttributes(&AbciHandler{ChainID: chainID, ID: getChainAppIdentifier(chainID)})...)
+	return event
+}
+
+// expectedTxResult creates an expected tx result tagged with the originating chain app
+func expectedTxResult(chainID string, gas int64) *abcitypes.ExecTxResult {
+	id := getChainAppIdentifier(chainID)
+	return &abcitypes.ExecTxResult{
+		Info:      chainID,
+		GasWanted: gas,
+		GasUsed:   gas,
+		Events: []abcitypes.Event{{
+			Type: "megablocks",
+			Attributes: []abcitypes.EventAttribute{
+				{Key: "chain_id", Value: chainID, Index: true},
+				{Key: "app_id", Value: hex.EncodeToString(id[:]), Index: true},
+			},
+		}},
+	}
+}
+
+func TestTxHashIndex(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.SetTxHashIndex(NewTxHashIndex(dbm.NewMemDB()))
+
+	tx := append(createHeader("chainA"), 0x01, 0x02)
+	cosmux.txIndex.Add(tx, "chainA", 5, 0)
+
+	// records are not visible before commit
+	resp, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathTxHash, Data: comettypes.Tx(tx).Hash()})
+	if err != nil || resp.Code != CodeQueryFailed {
+		t.Fatalf("expected tx hash not to be found: resp=%v, err=%v", resp, err)
+	}
+	if err := cosmux.txIndex.Flush(); err != nil {
+		t.Fatalf("error flushing index: %v", err)
+	}
+
+	for _, hash := range [][]byte{comettypes.Tx(tx).Hash(), comettypes.Tx(tx[MbHeaderLen:]).Hash()} {
+		resp, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathTxHash, Data: hash})
+		if err != nil || resp.Code != 0 {
+			t.Fatalf("tx hash query failed: resp=%v, err=%v", resp, err)
+		}
+		records := []TxHashRecord{}
+		if err := json.Unmarshal(resp.Value, &records); err != nil {
+			t.Fatalf("error decoding records: %v", err)
+		}
+		if len(records) != 1 || records[0].ChainID != "chainA" || records[0].Height != 5 ||
+			records[0].OuterHash != fmt.Sprintf("%X", comettypes.Tx(tx).Hash()) {
+			t.Errorf("unexpected records: %+v", records)
+		}
+	}
+}
+
+func TestBatchQuery(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// chainA serves any height and leaves the height of the response unset, chainB only up to height 5
+	mockclientA := mocks.NewMockClient(mockCtrl)
+	mockclientA.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			return &abcitypes.ResponseQuery{Value: []byte("a")}, nil
+		}).AnyTimes()
+	mockclientB := mocks.NewMockClient(mockCtrl)
+	mockclientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			if req.Height > 5 {
+				return &abcitypes.ResponseQuery{Code: 1, Log: "height not available"}, nil
+			}
+			return &abcitypes.ResponseQuery{Value: []byte("b"), Height: req.Height}, nil
+		}).AnyTimes()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		getChainAppIdentifier("chainA"): {ChainID: "chainA", ID: getChainAppIdentifier("chainA"), client: mockclientA},
+		getChainAppIdentifier("chainB"): {ChainID: "chainB", ID: getChainAppIdentifier("chainB"), client: mockclientB},
+	}
+	cosmux.committedHeight.Store(5)
+
+	batch, _ := json.Marshal([]BatchQueryEntry{{ChainID: "chainB", Path: "/key"}, {ChainID: "chainA", Path: "/key"}})
+	resp, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathBatch, Data: batch})
+	if err != nil || resp.Code != 0 || resp.Height != 5 {
+		t.Fatalf("batch query failed: resp=%v, err=%v", resp, err)
+	}
+	results := []BatchQueryResult{}
+	if err := json.Unmarshal(resp.Value, &results); err != nil {
+		t.Fatalf("error decoding results: %v", err)
+	}
+	if len(results) != 2 || string(results[0].Response.Value) != "b" || string(results[1].Response.Value) != "a" {
+		t.Errorf("unexpected batch results: %+v", results)
+	}
+
+	// chainB cannot serve the height
+	cosmux.committedHeight.Store(6)
+	resp, err = cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathBatch, Data: batch})
+	if err != nil || resp.Code != CodeQueryFailed {
+		t.Errorf("expected batch query to fail: resp=%v, err=%v", resp, err)
+	}
+
+	// height not committed yet
+	resp, err = cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathBatch, Data: batch, Height: 7})
+	if err != nil || resp.Code != CodeQueryFailed {
+		t.Errorf("expected batch query on uncommitted height to fail: resp=%v, err=%v", resp, err)
+	}
+}
+
+// countingCounter counts all increments regardless of labels
+type countingCounter struct {
+	labels []string
+	total  float64
+}
+
+func (c *countingCounter) With(labelValues ...string) metrics.Counter {
+	c.labels = append(c.labels, labelValues...)
+	return c
+}
+func (c *countingCounter) Add(delta float64) { c.total += delta }
+
+func TestShadowApps(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA := getChainAppIdentifier("chainA")
+	primary := mocks.NewMockClient(mockCtrl)
+	primary.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{
+		TxResults: []*abcitypes.ExecTxResult{{Code: 0}, {Code: 0}},
+		AppHash:   []byte{0xa1},
+	}, nil).Times(1)
+	primary.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	// the shadow hangs until released, which must not hold up the primary
+	release := make(chan struct{})
+	shadow := mocks.NewMockClient(mockCtrl)
+	shadow.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			<-release
+			return &abcitypes.ResponseFinalizeBlock{
+				TxResults: []*abcitypes.ExecTxResult{{Code: 0}, {Code: 5}},
+				AppHash:   []byte{0xa2},
+			}, nil
+		}).Times(1)
+	shadow.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: primary},
+	}
+	if err := cosmux.addShadow(&AbciHandler{ChainID: "chainA", ID: idA, client: shadow}); err != nil {
+		t.Fatalf("error adding shadow: %v", err)
+	}
+	if err := cosmux.addShadow(&AbciHandler{ChainID: "chainB", ID: getChainAppIdentifier("chainB")}); err == nil {
+		t.Errorf("expected shadow of unknown chain app to be rejected")
+	}
+	counter := &countingCounter{}
+	metrics := NopMetrics()
+	metrics.ShadowDivergences = counter
+	cosmux.SetMetrics(metrics)
+
+	response, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{
+		Height: 1,
+		Txs:    [][]byte{append(createHeader("chainA"), 0xa0), append(createHeader("chainA"), 0xa1)},
+	})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	// shadow responses never reach consensus
+	if !bytes.Equal(response.AppHash, []byte{0xa1}) || response.TxResults[1].Code != 0 {
+		t.Errorf("shadow response leaked into consensus: %v", response)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Errorf("Commit failed: %v", err)
+	}
+
+	close(release)
+	waitShadow(cosmux.shadows[idA])
+	// diverging tx result and app hash
+	if counter.total != 2 {
+		t.Errorf("unexpected number of divergences: got=%v, want=2 (labels=%v)", counter.total, counter.labels)
+	}
+}
+
+func TestShadowQueueOverflow(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", ShadowQueueSize: 1},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA := getChainAppIdentifier("chainA")
+	primary := mocks.NewMockClient(mockCtrl)
+	// the shadow hangs in FinalizeBlock, so Commit is queued and the next call overflows
+	started, release := make(chan struct{}), make(chan struct{})
+	shadow := mocks.NewMockClient(mockCtrl)
+	shadow.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			close(started)
+			<-release
+			return &abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xa1}}, nil
+		}).Times(1)
+	shadow.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{idA: {ChainID: "chainA", ID: idA, client: primary}}
+	if err := cosmux.addShadow(&AbciHandler{ChainID: "chainA", ID: idA, client: shadow}); err != nil {
+		t.Fatalf("error adding shadow: %v", err)
+	}
+	stopped := &recordingGauge{}
+	metrics := NopMetrics()
+	metrics.ShadowStopped = stopped
+	cosmux.SetMetrics(metrics)
+
+	req := &abcitypes.RequestFinalizeBlock{Height: 1}
+	resp := &abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xa1}}
+	cosmux.shadowFinalizeBlock(idA, req, resp)
+	<-started
+	cosmux.finalizedHeight = 1
+	cosmux.shadowCommit(&abcitypes.RequestCommit{})
+	cosmux.shadowFinalizeBlock(idA, &abcitypes.RequestFinalizeBlock{Height: 2}, resp)
+
+	query, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathShadows})
+	if err != nil || !query.IsOK() {
+		t.Fatalf("shadow status query failed: %v, %v", query, err)
+	}
+	status := []ShadowStatus{}
+	if err := json.Unmarshal(query.Value, &status); err != nil {
+		t.Fatalf("error decoding shadow status: %v", err)
+	}
+	if len(status) != 1 || !status[0].Stopped || status[0].StoppedAt != 2 || status[0].QueueSize != 1 {
+		t.Errorf("unexpected shadow status: %+v", status)
+	}
+	if stopped.value != 1 {
+		t.Errorf("stopped shadow not reported in metrics")
+	}
+	close(release)
+	waitShadow(cosmux.shadows[idA])
+}
+
+// recordingGauge records the last value set regardless of labels
+type recordingGauge struct {
+	value float64
+}
+
+func (g *recordingGauge) With(...string) metrics.Gauge { return g }
+func (g *recordingGauge) Set(value float64)            { g.value = value }
+func (g *recordingGauge) Add(delta float64)            { g.value += delta }
+
+// waitShadow returns once the shadow processed all queued calls
+func waitShadow(shadow *shadowRunner) {
+	done := make(chan struct{})
+	shadow.calls <- func(context.Context) { close(done) }
+	<-done
+}
+
+func TestReadReplicas(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	primary := mocks.NewMockClient(mockCtrl)
+	primary.EXPECT().Query(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseQuery{Info: "primary"}, nil).AnyTimes()
+	replicaClient := mocks.NewMockClient(mockCtrl)
+	replicaClient.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 5}, nil).AnyTimes()
+	gomock.InOrder(
+		replicaClient.EXPECT().Query(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseQuery{Info: "replica"}, nil).Times(2),
+		replicaClient.EXPECT().Query(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("connection lost")).Times(1),
+	)
+
+	idA := getChainAppIdentifier("chainA")
+	replicas := NewReplicaSet(cosmux.log, &Replica{Address: "replica", client: replicaClient})
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: primary, replicas: replicas},
+	}
+	query := func(height int64) string {
+		resp, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{ChainId: "chainA", Height: height})
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		return resp.Info
+	}
+
+	// replicas are unhealthy until refreshed
+	cosmux.committedHeight.Store(5)
+	if served := query(0); served != "primary" {
+		t.Errorf("expected query to be served by primary before refresh, got %s", served)
+	}
+
+	replicas.Refresh(context.Background())
+	if served := query(0); served != "replica" {
+		t.Errorf("expected latest height to be served by replica, got %s", served)
+	}
+	if served := query(4); served != "replica" {
+		t.Errorf("expected height 4 to be served by replica, got %s", served)
+	}
+
+	// replica behind the requested height
+	if served := query(6); served != "primary" {
+		t.Errorf("expected height 6 to be served by primary, got %s", served)
+	}
+
+	// failing replica falls back to primary and is marked unhealthy
+	if served := query(5); served != "primary" {
+		t.Errorf("expected fallback to primary, got %s", served)
+	}
+	if replicas.Select(1) != nil {
+		t.Errorf("expected failed replica to be unhealthy")
+	}
+}
+
+func TestReplicaRefreshAsync(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	replicaClient := mocks.NewMockClient(mockCtrl)
+	replicaClient.EXPECT().Info(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *abcitypes.RequestInfo) (*abcitypes.ResponseInfo, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("expected refresh with a deadline")
+			}
+			started <- struct{}{}
+			<-release
+			return &abcitypes.ResponseInfo{LastBlockHeight: 5}, nil
+		}).Times(2)
+	replicas := NewReplicaSet(NewMultiplexer(&CosmuxConfig{LogLevel: "debug"}).log, &Replica{Address: "replica", client: replicaClient})
+
+	// refreshes are skipped while one is running
+	replicas.RefreshAsync()
+	<-started
+	replicas.RefreshAsync()
+	replicas.RefreshAsync()
+	close(release)
+	for replicas.refreshing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if replicas.Select(5) == nil {
+		t.Errorf("expected replica to be refreshed")
+	}
+
+	replicas.RefreshAsync()
+	<-started
+	for replicas.refreshing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionRouting(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// each method must only reach the connection of its type
+	consensusConn := mocks.NewMockClient(mockCtrl)
+	consensusConn.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{}, nil).Times(1)
+	consensusConn.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	mempoolConn := mocks.NewMockClient(mockCtrl)
+	mempoolConn.EXPECT().CheckTx(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCheckTx{}, nil).Times(1)
+	queryConn := mocks.NewMockClient(mockCtrl)
+	queryConn.EXPECT().Query(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseQuery{}, nil).Times(1)
+	queryConn.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{}, nil).Times(1)
+
+	idA := getChainAppIdentifier("chainA")
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: consensusConn, mempoolConn: mempoolConn, queryConn: queryConn},
+	}
+	ctx := context.Background()
+	tx := append(createHeader("chainA"), 0xa0)
+
+	if _, err := cosmux.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: tx}); err != nil {
+		t.Errorf("CheckTx failed: %v", err)
+	}
+	if _, err := cosmux.Query(ctx, &abcitypes.RequestQuery{ChainId: "chainA"}); err != nil {
+		t.Errorf("Query failed: %v", err)
+	}
+	if _, err := cosmux.Info(ctx, &abcitypes.RequestInfo{}); err != nil {
+		t.Errorf("Info failed: %v", err)
+	}
+	if _, err := cosmux.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 1, Txs: [][]byte{tx}}); err != nil {
+		t.Errorf("FinalizeBlock failed: %v", err)
+	}
+	if _, err := cosmux.Commit(ctx, &abcitypes.RequestCommit{}); err != nil {
+		t.Errorf("Commit failed: %v", err)
+	}
+}
+
+func TestConcurrentClient(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// CheckTx of chainA blocks until released
+	release := make(chan struct{})
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().CheckTx(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *abcitypes.RequestCheckTx) (*abcitypes.ResponseCheckTx, error) {
+			<-release
+			return &abcitypes.ResponseCheckTx{}, nil
+		}).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().CheckTx(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCheckTx{}, nil).Times(1)
+
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+
+	if _, err := NewLocalClientCreator(cosmux, "unknown"); err == nil {
+		t.Errorf("expected unknown client mode to fail")
+	}
+	creator, err := NewLocalClientCreator(cosmux, ClientModeConcurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mempoolConn, err := creator.NewABCIClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doneA := make(chan error)
+	go func() {
+		_, err := mempoolConn.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: append(createHeader("chainA"), 0xa0)})
+		doneA <- err
+	}()
+
+	// chainB is not blocked by the pending CheckTx of chainA on the same connection
+	if _, err := mempoolConn.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: append(createHeader("chainB"), 0xb0)}); err != nil {
+		t.Errorf("CheckTx of chainB failed: %v", err)
+	}
+	close(release)
+	if err := <-doneA; err != nil {
+		t.Errorf("CheckTx of chainA failed: %v", err)
+	}
+}
+
+func TestParallelCommit(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA, idB, idC := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB"), getChainAppIdentifier("chainC")
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{RetainHeight: 7}, nil).Times(2)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{RetainHeight: 3}, nil).Times(2)
+	clientC := mocks.NewMockClient(mockCtrl)
+	gomock.InOrder(
+		clientC.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{RetainHeight: 5}, nil),
+		clientC.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("disk full")),
+	)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+		idC: {ChainID: "chainC", ID: idC, client: clientC},
+	}
+
+	cosmux.finalizedHeight = 10
+	response, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{})
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if response.RetainHeight != 3 {
+		t.Errorf("expected minimum retain height: got=%d, want=3", response.RetainHeight)
+	}
+	if cosmux.committedHeight.Load() != 10 {
+		t.Errorf("committed height not updated: %d", cosmux.committedHeight.Load())
+	}
+
+	// chainC fails to commit
+	cosmux.finalizedHeight = 11
+	_, err = cosmux.Commit(context.Background(), &abcitypes.RequestCommit{})
+	partial, ok := err.(*PartialCommitError)
+	if !ok {
+		t.Fatalf("expected partial commit error, got %v", err)
+	}
+	if partial.Height != 11 || len(partial.Failed) != 1 || partial.Failed["chainC"] == nil || len(partial.Committed) != 2 {
+		t.Errorf("unexpected partial commit report: %v", partial)
+	}
+	if cosmux.committedHeight.Load() != 10 {
+		t.Errorf("committed height must not advance on partial commit: %d", cosmux.committedHeight.Load())
+	}
+}
+
+func TestOptimisticExecution(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", OptimisticExecution: true},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA := getChainAppIdentifier("chainA")
+	executed := []string{}
+	var mtx sync.Mutex
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().ProcessProposal(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_ACCEPT}, nil).Times(2)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			executed = append(executed, string(req.Hash))
+			return &abcitypes.ResponseFinalizeBlock{AppHash: req.Hash}, nil
+		}).Times(3)
+	clientA.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			executed = append(executed, fmt.Sprintf("%s@%d", req.Path, binary.BigEndian.Uint64(req.Data)))
+			return &abcitypes.ResponseQuery{}, nil
+		}).Times(1)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+	}
+	ctx := context.Background()
+	txs := [][]byte{append(createHeader("chainA"), 0xa0)}
+
+	// decided block matches the accepted proposal: result is reused
+	if _, err := cosmux.ProcessProposal(ctx, &abcitypes.RequestProcessProposal{Height: 1, Hash: []byte("h1"), Txs: txs}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := cosmux.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 1, Hash: []byte("h1"), Txs: txs})
+	if err != nil || string(response.AppHash) != "h1" {
+		t.Fatalf("unexpected FinalizeBlock result: resp=%v, err=%v", response, err)
+	}
+
+	// a different block is decided: the optimistic state is discarded and the block re-executed
+	if _, err := cosmux.ProcessProposal(ctx, &abcitypes.RequestProcessProposal{Height: 2, Hash: []byte("h2"), Txs: txs}); err != nil {
+		t.Fatal(err)
+	}
+	response, err = cosmux.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 2, Hash: []byte("h2'"), Txs: txs})
+	if err != nil || string(response.AppHash) != "h2'" {
+		t.Fatalf("unexpected FinalizeBlock result: resp=%v, err=%v", response, err)
+	}
+
+	if want := []string{"h1", "h2", QueryPathRollback + "@2", "h2'"}; !reflect.DeepEqual(executed, want) {
+		t.Errorf("unexpected executions: got=%v, want=%v", executed, want)
+	}
+	if cosmux.finalizedHeight != 2 {
+		t.Errorf("unexpected finalized height: %d", cosmux.finalizedHeight)
+	}
+}
+
+func TestActivationRetried(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA := getChainAppIdentifier("chainA")
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{
+		Validators: []abcitypes.ValidatorUpdate{{Power: 7}},
+	}, nil).Times(1)
+	hdlr := &AbciHandler{ChainID: "chainA", ID: idA, client: clientA, ActivationHeight: 5,
+		activation: newActivationRecord(idA, false)}
+	db := dbm.NewMemDB()
+	if err := hdlr.activation.Load(db); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &abcitypes.RequestFinalizeBlock{Height: 5}
+	for i := 0; i < 2; i++ {
+		resp, err := activateChainApp(context.Background(), hdlr, req)
+		if err != nil || len(resp.Validators) != 1 || resp.Validators[0].Power != 7 {
+			t.Fatalf("unexpected activation: resp=%v, err=%v", resp, err)
+		}
+	}
+
+	// the activation survives a restart
+	restarted := newActivationRecord(idA, false)
+	if err := restarted.Load(db); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.resp == nil || len(restarted.resp.Validators) != 1 {
+		t.Errorf("activation not recorded: %v", restarted.resp)
+	}
+	if err := restarted.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get(restarted.key); value != nil {
+		t.Errorf("activation not reset")
+	}
+}
+
+func TestSkipUnchangedRechecks(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", SkipUnchangedRechecks: true},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	// chainA executes the block with an unchanged app hash and is rechecked nevertheless
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().CheckTx(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCheckTx{GasWanted: 1}, nil).Times(2)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa1}}, nil).Times(1)
+	// sparse chainB does not receive the block and is only called once for the new transaction
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().CheckTx(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCheckTx{GasWanted: 2}, nil).Times(1)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB, sparse: NewSparseHeights(idB)},
+	}
+	cosmux.appHashes = map[ChainAppIdentifier][]byte{idA: {0xa1}, idB: {0xb1}}
+	ctx := context.Background()
+
+	txA, txB := append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)
+	for _, tx := range [][]byte{txA, txB} {
+		if _, err := cosmux.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: append([]byte{}, tx...), Type: abcitypes.CheckTxType_New}); err != nil {
+			t.Fatalf("CheckTx failed: %v", err)
+		}
+	}
+
+	// block drives chainA only
+	_, err := cosmux.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 1, Txs: [][]byte{append(createHeader("chainA"), 0xa1)}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+
+	for _, tx := range [][]byte{txA, txB} {
+		resp, err := cosmux.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: append([]byte{}, tx...), Type: abcitypes.CheckTxType_Recheck})
+		if err != nil || resp.IsErr() {
+			t.Fatalf("recheck failed: resp=%v, err=%v", resp, err)
+		}
+		if bytes.Equal(tx, txB) && resp.GasWanted != 2 {
+			t.Errorf("expected earlier result of chainB, got %v", resp)
+		}
+	}
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", TwoPhaseCommit: true},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// records the two-phase commit calls per chain app
+	var mtx sync.Mutex
+	calls := map[string][]string{}
+	prepareFails := map[string]bool{}
+	controlQuery := func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls[req.ChainId] = append(calls[req.ChainId], req.Path)
+		if req.Path == QueryPathPrepareCommit && prepareFails[req.ChainId] {
+			return &abcitypes.ResponseQuery{Code: 1, Log: "cannot prepare"}, nil
+		}
+		return &abcitypes.ResponseQuery{}, nil
+	}
+
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(controlQuery).AnyTimes()
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(controlQuery).AnyTimes()
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("disk full")).Times(1)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+	cosmux.finalizedHeight = 5
+
+	// chainB cannot prepare: nothing is committed and all apps are rolled back
+	prepareFails["chainB"] = true
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err == nil {
+		t.Fatalf("expected commit to fail when prepare fails")
+	}
+	want := []string{QueryPathPrepareCommit, QueryPathRollback}
+	if !reflect.DeepEqual(calls["chainA"], want) || !reflect.DeepEqual(calls["chainB"], want) {
+		t.Errorf("unexpected calls on failed prepare: %v", calls)
+	}
+
+	// chainB fails to commit after chainA committed: all apps are rolled back
+	prepareFails["chainB"] = false
+	calls = map[string][]string{}
+	_, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{})
+	partial, ok := err.(*PartialCommitError)
+	if !ok {
+		t.Fatalf("expected partial commit error, got %v", err)
+	}
+	if !reflect.DeepEqual(partial.Committed, []string{"chainA"}) || len(partial.RolledBack) != 2 || len(partial.RollbackFailed) != 0 {
+		t.Errorf("unexpected partial commit report: %v", partial)
+	}
+	if !reflect.DeepEqual(calls["chainA"], want) || !reflect.DeepEqual(calls["chainB"], want) {
+		t.Errorf("unexpected calls on failed commit: %v", calls)
+	}
+	if cosmux.committedHeight.Load() != 0 {
+		t.Errorf("committed height must not advance: %d", cosmux.committedHeight.Load())
+	}
+}
+
+func TestTwoPhaseCommitSparse(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", TwoPhaseCommit: true},
+	)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txA, txB := append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)
+
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{AppHash: []byte{0xa0}}, nil).Times(1)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xa1}}, nil).Times(3)
+	clientA.EXPECT().Query(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseQuery{}, nil).AnyTimes()
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(3)
+
+	// the control queries of the sparse chainB carry its own heights
+	controlHeights := []int64{}
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{AppHash: []byte{0xb0}}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb1}}, nil).Times(2)
+	clientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			if req.Path != QueryPathPrepareCommit || int64(binary.BigEndian.Uint64(req.Data)) != req.Height {
+				t.Errorf("unexpected control query of chainB: %v", req)
+			}
+			controlHeights = append(controlHeights, req.Height)
+			return &abcitypes.ResponseQuery{}, nil
+		}).Times(2)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(2)
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: idB, client: clientB, sparse: NewSparseHeights(idB)}
+	hdlrB.translateConnections()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: hdlrB,
+	}
+	if _, err := cosmux.InitChain(context.Background(), &abcitypes.RequestInitChain{InitialHeight: 1}); err != nil {
+		t.Fatalf("InitChain failed: %v", err)
+	}
+
+	// chainB is driven at heights 1 and 3, which are its heights 1 and 2
+	for _, block := range []struct {
+		height int64
+		txs    [][]byte
+	}{{1, [][]byte{txA, txB}}, {2, [][]byte{txA}}, {3, [][]byte{txB}}} {
+		if _, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: block.height, Txs: block.txs}); err != nil {
+			t.Fatalf("FinalizeBlock at height %d failed: %v", block.height, err)
+		}
+		if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+			t.Fatalf("Commit at height %d failed: %v", block.height, err)
+		}
+	}
+	if !reflect.DeepEqual(controlHeights, []int64{1, 2}) {
+		t.Errorf("unexpected heights of control queries of chainB: %v", controlHeights)
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+
+	capabilities := map[string]*abcitypes.ResponseQuery{
+		"chainA": {Value: []byte(`["/megablocks/commit/prepare","/megablocks/commit/rollback"]`)},
+		"chainB": {Value: []byte(`["/megablocks/commit/rollback"]`)},
+	}
+	capabilityQuery := func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+		if req.Path != QueryPathCapabilities {
+			t.Errorf("unexpected query: %v", req)
+		}
+		return capabilities[req.ChainId], nil
+	}
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(capabilityQuery).AnyTimes()
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(capabilityQuery).AnyTimes()
+	check := func(cfg *CosmuxConfig) error {
+		cosmux := NewMultiplexer(cfg)
+		cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+			idA: {ChainID: "chainA", ID: idA, client: clientA},
+			idB: {ChainID: "chainB", ID: idB, client: clientB, SunsetHeight: 10},
+		}
+		return cosmux.CheckCapabilities(context.Background())
+	}
+
+	if err := check(&CosmuxConfig{LogLevel: "debug", OptimisticExecution: true}); err != nil {
+		t.Errorf("expected optimistic execution to be supported: %v", err)
+	}
+	if err := check(&CosmuxConfig{LogLevel: "debug", TwoPhaseCommit: true}); err == nil || !strings.Contains(err.Error(), "chainB") {
+		t.Errorf("expected two-phase commit to be refused for chainB: %v", err)
+	}
+	if err := check(&CosmuxConfig{LogLevel: "debug", ExportDir: t.TempDir()}); err == nil {
+		t.Errorf("expected export of retiring chainB to be refused")
+	}
+
+	// chain apps without the capabilities query implement no query path
+	capabilities["chainB"] = &abcitypes.ResponseQuery{Code: 1, Log: "unknown query path"}
+	if err := check(&CosmuxConfig{LogLevel: "debug", OptimisticExecution: true}); err == nil {
+		t.Errorf("expected optimistic execution to be refused for chainB")
+	}
+	if err := check(&CosmuxConfig{LogLevel: "debug"}); err != nil {
+		t.Errorf("expected no capabilities to be required: %v", err)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	walDB := dbm.NewMemDB()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txs := [][]byte{append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)}
+
+	// chainB fails to commit height 3
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.SetWAL(NewWAL(walDB))
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa3}}, nil).Times(1)
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb3}}, nil).Times(1)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("crash")).Times(1)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+	if _, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 3, Txs: txs}); err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err == nil {
+		t.Fatalf("expected Commit to fail")
+	}
+
+	// after restart only chainB executes and commits height 3 again
+	restarted := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	restarted.SetWAL(NewWAL(walDB))
+	restarted.SetTxHashIndex(NewTxHashIndex(dbm.NewMemDB()))
+	restartedB := mocks.NewMockClient(mockCtrl)
+	restartedB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 2}, nil).Times(1)
+	restartedB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if req.Height != 3 || len(req.Txs) != 1 || !bytes.Equal(req.Txs[0], []byte{0xb0}) {
+				t.Errorf("unexpected re-executed request: %v", req)
+			}
+			return &abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb3}}, nil
+		}).Times(1)
+	restartedB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	restarted.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: mocks.NewMockClient(mockCtrl)},
+		idB: {ChainID: "chainB", ID: idB, client: restartedB},
+	}
+	if err := restarted.Recover(context.Background()); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if restarted.committedHeight.Load() != 3 || !bytes.Equal(restarted.appHashes[idA], []byte{0xa3}) {
+		t.Errorf("unexpected state after recovery: height=%d, app hashes=%v", restarted.committedHeight.Load(), restarted.appHashes)
+	}
+	if records, err := restarted.txIndex.Lookup(comettypes.Tx([]byte{0xb0}).Hash()); err != nil || len(records) != 1 || records[0].Height != 3 {
+		t.Errorf("expected tx of recovered height to be indexed: %v, %v", records, err)
+	}
+
+	// nothing left to recover
+	record, err := NewWAL(walDB).Load()
+	if err != nil || !record.Committed[idA] || !record.Committed[idB] {
+		t.Errorf("expected all apps to be committed in WAL: %+v, %v", record, err)
+	}
+}
+
+func TestWALRecoveryWithoutCommit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	walDB := dbm.NewMemDB()
+	idA := getChainAppIdentifier("chainA")
+	txA := append(createHeader("chainA"), 0xa0)
+
+	// the multiplexer crashes after finalizing height 3, before any chain app committed
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.SetWAL(NewWAL(walDB))
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa3}}, nil).Times(1)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{idA: {ChainID: "chainA", ID: idA, client: clientA}}
+	if _, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 3, Txs: [][]byte{txA}}); err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+
+	// the height is left to the handshake, no chain app is called and no state is set
+	restarted := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	restarted.SetWAL(NewWAL(walDB))
+	restarted.SetTxHashIndex(NewTxHashIndex(dbm.NewMemDB()))
+	restarted.clients = map[ChainAppIdentifier]*AbciHandler{idA: {ChainID: "chainA", ID: idA, client: mocks.NewMockClient(mockCtrl)}}
+	if err := restarted.Recover(context.Background()); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if restarted.committedHeight.Load() != 0 || restarted.finalizedHeight != 0 || len(restarted.appHashes) != 0 {
+		t.Errorf("unexpected state after recovery: height=%d, app hashes=%v", restarted.committedHeight.Load(), restarted.appHashes)
+	}
+	if records, err := restarted.txIndex.Lookup(comettypes.Tx([]byte{0xa0}).Hash()); err != nil || len(records) != 0 {
+		t.Errorf("expected tx of uncommitted height not to be indexed: %v, %v", records, err)
+	}
+}
+
+// replayBlockStore serves the blocks of a block store starting at height 1
+type replayBlockStore struct {
+	sm.BlockStore
+	blocks []*comettypes.Block
+}
+
+func (s replayBlockStore) Base() int64   { return 1 }
+func (s replayBlockStore) Height() int64 { return int64(len(s.blocks)) }
+func (s replayBlockStore) LoadBlock(height int64) *comettypes.Block {
+	if height < 1 || height > int64(len(s.blocks)) {
+		return nil
+	}
+	return s.blocks[height-1]
+}
+
+func (s replayBlockStore) LoadBlockMeta(height int64) *comettypes.BlockMeta {
+	if block := s.LoadBlock(height); block != nil {
+		return &comettypes.BlockMeta{Header: block.Header}
+	}
+	return nil
+}
+
+// replayStores creates the stores of a node at height 3 with blocks signed by a single validator.
+// Each block contains a transaction of chainA and chainB.
+func replayStores(t *testing.T) (replayBlockStore, sm.Store, *AppHashStore) {
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	val, _ := comettypes.RandValidator(false, 10)
+	valSet := comettypes.NewValidatorSet([]*comettypes.Validator{val})
+	blockStore := replayBlockStore{}
+	stateStore := sm.NewStore(dbm.NewMemDB(), sm.StoreOptions{})
+	appHashStore := NewAppHashStore(dbm.NewMemDB())
+
+	composite := []byte{}
+	for height := int64(1); height <= 3; height++ {
+		lastCommit := &comettypes.Commit{Height: height - 1, Signatures: []comettypes.CommitSig{
+			{BlockIDFlag: comettypes.BlockIDFlagCommit, ValidatorAddress: val.Address},
+		}}
+		block := comettypes.MakeBlock(height, []comettypes.Tx{
+			append(createHeader("chainA"), 0xa0),
+			append(createHeader("chainB"), byte(height)),
+		}, lastCommit, nil)
+		block.AppHash = composite
+		blockStore.blocks = append(blockStore.blocks, block)
+		err := stateStore.SaveFinalizeBlockResponse(height, &abcitypes.ResponseFinalizeBlock{
+			TxResults: []*abcitypes.ExecTxResult{{}, {}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		appHashes := map[ChainAppIdentifier][]byte{idA: {0xa0, byte(height)}, idB: {0xb0, byte(height)}}
+		if err := appHashStore.Save(height, appHashes); err != nil {
+			t.Fatal(err)
+		}
+		composite = compositeAppHash(appHashes)
+	}
+
+	state := sm.State{InitialHeight: 1, Validators: valSet, NextValidators: valSet, LastValidators: valSet, AppHash: composite}
+	if err := stateStore.Bootstrap(state); err != nil {
+		t.Fatal(err)
+	}
+	return blockStore, stateStore, appHashStore
+}
+
+func TestReplayLagging(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	blockStore, stateStore, appHashStore := replayStores(t)
+
+	// chainB restarted at height 1 and replays heights 2 and 3, chainA is left untouched
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.SetAppHashStore(appHashStore)
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().Info(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseInfo{LastBlockHeight: 3, LastBlockAppHash: []byte{0xa0, 3}}, nil).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseInfo{LastBlockHeight: 1, LastBlockAppHash: []byte{0xb0, 1}}, nil).Times(1)
+	replayed := []int64{}
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if len(req.Txs) != 1 || !bytes.Equal(req.Txs[0], []byte{byte(req.Height)}) {
+				t.Errorf("unexpected replayed txs: %v", req.Txs)
+			}
+			if len(req.DecidedLastCommit.Votes) != 1 {
+				t.Errorf("unexpected last commit: %v", req.DecidedLastCommit)
+			}
+			replayed = append(replayed, req.Height)
+			return &abcitypes.ResponseFinalizeBlock{
+				TxResults: []*abcitypes.ExecTxResult{{}},
+				AppHash:   []byte{0xb0, byte(req.Height)},
+			}, nil
+		}).Times(2)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(2)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+
+	// sparse chainC was never driven as the blocks have none of its transactions, it is not lagging
+	idC := getChainAppIdentifier("chainC")
+	clientC := mocks.NewMockClient(mockCtrl)
+	clientC.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{}, nil).Times(1)
+	sparseC := NewSparseHeights(idC)
+	cosmux.clients[idC] = &AbciHandler{ChainID: "chainC", ID: idC, client: &sparseHeightClient{Client: clientC, heights: sparseC}, sparse: sparseC}
+
+	if err := cosmux.ReplayLagging(context.Background(), blockStore, stateStore); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if !reflect.DeepEqual(replayed, []int64{2, 3}) {
+		t.Errorf("unexpected replayed heights: %v", replayed)
+	}
+	if cosmux.committedHeight.Load() != 3 || !bytes.Equal(cosmux.appHashes[idB], []byte{0xb0, 3}) {
+		t.Errorf("unexpected state after replay: height=%d, app hashes=%v", cosmux.committedHeight.Load(), cosmux.appHashes)
+	}
+
+	// a replay diverging from the recorded app hashes fails
+	diverging := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	diverging.SetAppHashStore(appHashStore)
+	clientA = mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 3}, nil).Times(1)
+	clientB = mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 2}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xff}}, nil).Times(1)
+	diverging.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+	if err := diverging.ReplayLagging(context.Background(), blockStore, stateStore); err == nil {
+		t.Errorf("expected diverging replay to fail")
+	}
+
+	// without stored results blocks are replayed as long as no conditional transaction needs them
+	discarding := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	discarding.SetAppHashStore(appHashStore)
+	clientA = mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 3}, nil).Times(1)
+	clientB = mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 2}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb0, 3}}, nil).Times(1)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	discarding.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+	if err := discarding.ReplayLagging(context.Background(), blockStore, discardingStateStore{stateStore}); err != nil {
+		t.Errorf("replay without stored results failed: %v", err)
+	}
+	conditional := [][]byte{append(createHeader("chainA"), 0xa0), append(CreateConditionalHeader(idB, 0), 0xb0)}
+	if !discarding.dependsOnOthers(conditional, map[ChainAppIdentifier]bool{idB: true}) {
+		t.Errorf("expected conditional transaction of chainB to depend on chainA")
+	}
+	if discarding.dependsOnOthers(conditional, map[ChainAppIdentifier]bool{idA: true, idB: true}) {
+		t.Errorf("expected no dependency on chain apps which are not replayed")
+	}
+}
+
+// discardingStateStore behaves like a state store with 'discard_abci_responses' enabled
+type discardingStateStore struct {
+	sm.Store
+}
+
+func (s discardingStateStore) LoadFinalizeBlockResponse(int64) (*abcitypes.ResponseFinalizeBlock, error) {
+	return nil, sm.ErrFinalizeBlockResponsesNotPersisted
+}
+
+func TestRebuildChainApp(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	blockStore, stateStore, appHashStore := replayStores(t)
+	genesis := &comettypes.GenesisDoc{ChainID: "megablocks", InitialHeight: 1, ConsensusParams: comettypes.DefaultConsensusParams()}
+
+	// chainB is rebuilt from genesis, chainA is not connected
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.SetAppHashStore(appHashStore)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().InitChain(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestInitChain) (*abcitypes.ResponseInitChain, error) {
+			if req.ChainId != "chainB" || !bytes.Equal(req.AppStateBytes, []byte("{}")) {
+				t.Errorf("unexpected InitChain request: %v", req)
+			}
+			return &abcitypes.ResponseInitChain{}, nil
+		}).Times(1)
+	replayed := []int64{}
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if len(req.Txs) != 1 || !bytes.Equal(req.Txs[0], []byte{byte(req.Height)}) {
+				t.Errorf("unexpected replayed txs: %v", req.Txs)
+			}
+			replayed = append(replayed, req.Height)
+			return &abcitypes.ResponseFinalizeBlock{
+				TxResults: []*abcitypes.ExecTxResult{{}},
+				AppHash:   []byte{0xb0, byte(req.Height)},
+			}, nil
+		}).Times(3)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(3)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: mocks.NewMockClient(mockCtrl)},
+		idB: {ChainID: "chainB", ID: idB, client: clientB, InitAppStateBytes: []byte("{}")},
+	}
+	if err := cosmux.RebuildChainApp(context.Background(), "chainB", 0, blockStore, stateStore, genesis); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if !reflect.DeepEqual(replayed, []int64{1, 2, 3}) {
+		t.Errorf("unexpected replayed heights: %v", replayed)
+	}
+
+	// app hashes not matching the recorded composite app hash are reported
+	if err := appHashStore.Save(3, map[ChainAppIdentifier][]byte{idA: {0xff}}); err != nil {
+		t.Fatal(err)
+	}
+	clientB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 2}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb0, 3}}, nil).Times(1)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	if err := cosmux.RebuildChainApp(context.Background(), "chainB", 3, blockStore, stateStore, genesis); err == nil {
+		t.Errorf("expected rebuild with diverging composite app hash to fail")
+	}
+
+	// a sparse chain app without transactions in the blocks is only initialized
+	idC := getChainAppIdentifier("chainC")
+	clientC := mocks.NewMockClient(mockCtrl)
+	clientC.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{}, nil).Times(1)
+	cosmux.clients[idC] = &AbciHandler{ChainID: "chainC", ID: idC, client: clientC, sparse: NewSparseHeights(idC)}
+	if err := cosmux.RebuildChainApp(context.Background(), "chainC", 0, blockStore, stateStore, genesis); err != nil {
+		t.Errorf("rebuild of sparse chain app failed: %v", err)
+	}
+}
+
+func TestInitChainAppHashes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA := getChainAppIdentifier("chainA")
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.SetAppHashStore(NewAppHashStore(dbm.NewMemDB()))
+	clientA := mocks.NewMockClient(mockCtrl)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{idA: {ChainID: "chainA", ID: idA, client: clientA}}
+
+	// the app hashes of InitChain are stored at the height before the initial height
+	clientA.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{AppHash: []byte{0xa0}}, nil).Times(1)
+	if _, err := cosmux.InitChain(context.Background(), &abcitypes.RequestInitChain{InitialHeight: 1}); err != nil {
+		t.Fatalf("InitChain failed: %v", err)
+	}
+	if hash, err := cosmux.appHashStore.Load(0, idA); err != nil || !bytes.Equal(hash, []byte{0xa0}) {
+		t.Errorf("unexpected initial app hash: %X, %v", hash, err)
+	}
+}
+
+func TestLateJoiningChainApp(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txA, txB := append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)
+
+	// chainB joins at height 5 and sees it as its height 1
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientB := mocks.NewMockClient(mockCtrl)
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: idB, client: clientB, ActivationHeight: 5}
+	hdlrB.translateConnections()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: hdlrB,
+	}
+
+	clientA.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{AppHash: []byte{0xa0}}, nil).Times(1)
+	if _, err := cosmux.InitChain(context.Background(), &abcitypes.RequestInitChain{InitialHeight: 1}); err != nil {
+		t.Fatalf("InitChain failed: %v", err)
+	}
+
+	// transactions of chainB are rejected before its activation
+	cosmux.committedHeight.Store(3)
+	check, err := cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: txB})
+	if err != nil || check.Code != CodeChainAppInactive {
+		t.Errorf("expected CheckTx of inactive chain app to be rejected: %v, %v", check, err)
+	}
+	proposal, err := cosmux.ProcessProposal(context.Background(), &abcitypes.RequestProcessProposal{Height: 4, Txs: [][]byte{txB}})
+	if err != nil || proposal.Status != abcitypes.ResponseProcessProposal_REJECT {
+		t.Errorf("expected proposal with tx of inactive chain app to be rejected: %v, %v", proposal, err)
+	}
+	prepared, err := cosmux.PrepareProposal(context.Background(), &abcitypes.RequestPrepareProposal{Height: 4, Txs: [][]byte{txA, txB}})
+	if err != nil || len(prepared.Txs) != 1 || !bytes.Equal(prepared.Txs[0], txA) {
+		t.Errorf("expected tx of inactive chain app to be left out: %v, %v", prepared, err)
+	}
+
+	// only chainA executes height 4
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa4}}, nil).Times(1)
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	resp, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 4, Txs: [][]byte{txA}})
+	if err != nil || !bytes.Equal(resp.AppHash, []byte{0xa4}) {
+		t.Fatalf("unexpected FinalizeBlock result before activation: %v, %v", resp, err)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// chainB is initialized at height 5 and joins the composite app hash
+	validator := abcitypes.ValidatorUpdate{Power: 10}
+	clientB.EXPECT().InitChain(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestInitChain) (*abcitypes.ResponseInitChain, error) {
+			if req.InitialHeight != 1 || req.ChainId != "chainB" {
+				t.Errorf("unexpected activation request: %v", req)
+			}
+			return &abcitypes.ResponseInitChain{Validators: []abcitypes.ValidatorUpdate{validator}}, nil
+		}).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if req.Height != 1 {
+				t.Errorf("expected height 1 for chainB, got %d", req.Height)
+			}
+			return &abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb1}}, nil
+		}).Times(1)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xa5}}, nil).Times(1)
+	resp, err = cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 5, Txs: [][]byte{txB}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock at activation failed: %v", err)
+	}
+	expected := compositeAppHash(map[ChainAppIdentifier][]byte{idA: {0xa5}, idB: {0xb1}})
+	if !bytes.Equal(resp.AppHash, expected) || len(resp.ValidatorUpdates) != 0 {
+		t.Errorf("unexpected FinalizeBlock response at activation: %v", resp)
+	}
+
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{RetainHeight: 1}, nil).Times(1)
+	commit, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{})
+	if err != nil || commit.RetainHeight != 0 {
+		t.Errorf("unexpected Commit result: %v, %v", commit, err)
+	}
+
+	// heights of queries are translated in both directions
+	clientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			return &abcitypes.ResponseQuery{Height: req.Height}, nil
+		}).Times(1)
+	query, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{ChainId: "chainB", Height: 5})
+	if err != nil || query.Height != 5 {
+		t.Errorf("unexpected query height: %v, %v", query, err)
+	}
+	for _, height := range []int64{1, 4} {
+		query, err = cosmux.Query(context.Background(), &abcitypes.RequestQuery{ChainId: "chainB", Height: height})
+		if err != nil || query.Code != CodeQueryFailed {
+			t.Errorf("expected query at height %d before activation to fail: %v, %v", height, query, err)
+		}
+	}
+	clientB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 1}, nil).Times(1)
+	info, err := hdlrB.query().Info(context.Background(), &abcitypes.RequestInfo{})
+	if err != nil || info.LastBlockHeight != 5 {
+		t.Errorf("unexpected info height: %v, %v", info, err)
+	}
+}
+
+func TestSparseChainApp(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txA, txB := append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)
+	sparseDB := dbm.NewMemDB()
+
+	// chainB is only driven on heights with its transactions
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientB := mocks.NewMockClient(mockCtrl)
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: idB, client: clientB, sparse: NewSparseHeights(idB)}
+	hdlrB.translateConnections()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: hdlrB,
+	}
+	if err := cosmux.SetSparseHeightStore(sparseDB); err != nil {
+		t.Fatal(err)
+	}
+
+	clientA.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{AppHash: []byte{0xa0}}, nil).Times(1)
+	clientB.EXPECT().InitChain(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInitChain{AppHash: []byte{0xb0}}, nil).Times(1)
+	if _, err := cosmux.InitChain(context.Background(), &abcitypes.RequestInitChain{InitialHeight: 1}); err != nil {
+		t.Fatalf("InitChain failed: %v", err)
+	}
+
+	finalize := func(height int64, txs [][]byte, expected map[ChainAppIdentifier][]byte) {
+		resp, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: height, Txs: txs})
+		if err != nil {
+			t.Fatalf("FinalizeBlock at height %d failed: %v", height, err)
+		}
+		if !bytes.Equal(resp.AppHash, compositeAppHash(expected)) {
+			t.Errorf("unexpected app hash at height %d: %X", height, resp.AppHash)
+		}
+		if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+			t.Fatalf("Commit at height %d failed: %v", height, err)
+		}
+	}
+
+	// height 1 skips chainB which keeps its initial app hash
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa1}}, nil).Times(1)
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(3)
+	finalize(1, [][]byte{txA}, map[ChainAppIdentifier][]byte{idA: {0xa1}, idB: {0xb0}})
+
+	// height 2 is the first height of chainB
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xa2}}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if req.Height != 1 {
+				t.Errorf("expected height 1 for chainB, got %d", req.Height)
+			}
+			return &abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb1}}, nil
+		}).Times(1)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	finalize(2, [][]byte{txB}, map[ChainAppIdentifier][]byte{idA: {0xa2}, idB: {0xb1}})
+
+	// height 3 skips chainB again
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{AppHash: []byte{0xa3}}, nil).Times(1)
+	finalize(3, [][]byte{}, map[ChainAppIdentifier][]byte{idA: {0xa3}, idB: {0xb1}})
+
+	// heights of chainB are translated and recorded
+	clientB.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 1}, nil).Times(1)
+	info, err := hdlrB.query().Info(context.Background(), &abcitypes.RequestInfo{})
+	if err != nil || info.LastBlockHeight != 2 {
+		t.Errorf("unexpected info height: %v, %v", info, err)
+	}
+	clientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			return &abcitypes.ResponseQuery{Height: req.Height}, nil
+		}).Times(1)
+	query, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{ChainId: "chainB", Height: 3})
+	if err != nil || query.Height != 2 {
+		t.Errorf("unexpected query height: %v, %v", query, err)
+	}
+	query, err = cosmux.Query(context.Background(), &abcitypes.RequestQuery{ChainId: "chainB", Height: 1})
+	if err != nil || query.Code != CodeQueryFailed {
+		t.Errorf("expected query before first height of chainB to fail: %v, %v", query, err)
+	}
+	reloaded := NewSparseHeights(idB)
+	if err := reloaded.Load(sparseDB); err != nil || reloaded.muxHeight(1) != 2 || reloaded.appHeight(5) != 2 {
+		t.Errorf("unexpected reloaded heights: %v, %v", reloaded.heights, err)
+	}
+
+	// the height is recorded before the chain app commits, so a crash leaves no chain app ahead of its mapping
+	crashing := mocks.NewMockClient(mockCtrl)
+	crashing.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseFinalizeBlock{}, nil).Times(1)
+	crashing.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("crashed")).Times(1)
+	client := &sparseHeightClient{Client: crashing, heights: reloaded}
+	if _, err := client.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Commit(context.Background(), &abcitypes.RequestCommit{}); err == nil {
+		t.Fatalf("expected commit to fail")
+	}
+	if err := reloaded.Load(sparseDB); err != nil || reloaded.appHeight(7) != 2 {
+		t.Errorf("height not recorded before commit: %v, %v", reloaded.heights, err)
+	}
+}
+
+func TestSparseChainAppSiblingHashes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txA := append(createHeader("chainA"), 0xa0)
+
+	// chainB receives sibling app hashes and is driven without transactions of its own
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa1}}, nil).Times(1)
+	clientB := mocks.NewMockClient(mockCtrl)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if req.Height != 1 || len(req.Txs) != 1 || !IsSystemTx(req.Txs[0]) {
+				t.Errorf("expected only the sibling info at height 1 for chainB: %v", req)
+			}
+			return &abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb1}}, nil
+		}).Times(1)
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: idB, client: clientB, sparse: NewSparseHeights(idB), SiblingHashes: true}
+	hdlrB.translateConnections()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: hdlrB,
+	}
+
+	slots, err := cosmux.responseSlots(1, [][]byte{txA})
+	if _, driven := slots[idB]; err != nil || !driven {
+		t.Errorf("expected chainB to be driven by the sibling info: %v, %v", slots, err)
+	}
+	resp, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 1, Txs: [][]byte{txA}})
+	if err != nil || len(resp.TxResults) != 1 || cosmux.skippedApps[idB] {
+		t.Errorf("unexpected FinalizeBlock result: %v, %v", resp, err)
+	}
+}
+
+func TestSunsetChainApp(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txA, txB := append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)
+	exportDir := t.TempDir()
+
+	// chainB executes its last block at height 2
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", ExportDir: exportDir},
+	)
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientB := mocks.NewMockClient(mockCtrl)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA},
+		idB: {ChainID: "chainB", ID: idB, client: clientB},
+	}
+	genesis := &comettypes.GenesisDoc{ChainID: "megablocks", AppState: []byte(`{"sunset_heights":{"chainB":3}}`)}
+	if err := cosmux.SetGenesis(genesis); err != nil {
+		t.Fatalf("error setting genesis: %v", err)
+	}
+
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa2}}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb2}}, nil).Times(1)
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(2)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(1)
+	clientB.EXPECT().Query(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+			if req.Path != QueryPathExport || req.Height != 2 {
+				t.Errorf("unexpected export request: %v", req)
+			}
+			return &abcitypes.ResponseQuery{Value: []byte(`{"state":"b2"}`), Height: 2}, nil
+		}).Times(1)
+	clientB.EXPECT().IsRunning().Return(true).Times(1)
+	clientB.EXPECT().Stop().Return(nil).Times(1)
+	if _, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 2, Txs: [][]byte{txA, txB}}); err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// the state of chainB is exported after its last height
+	exported := []byte{}
+	for i := 0; i < 100 && len(exported) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		exported, _ = os.ReadFile(filepath.Join(exportDir, "chainB-2.json"))
+	}
+	if string(exported) != `{"state":"b2"}` {
+		t.Errorf("unexpected export of chainB: %s", exported)
+	}
+
+	// chainB is disconnected once exported, its last app hash is kept
+	hdlrB := cosmux.clients[idB]
+	for i := 0; i < 100 && !hdlrB.retired.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hdlrB.retired.Load() {
+		t.Fatalf("expected chainB to be disconnected after its export")
+	}
+	query, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{ChainId: "chainB"})
+	if err != nil || query.Code != CodeQueryFailed {
+		t.Errorf("expected query of retired chain app to fail: %v, %v", query, err)
+	}
+	if _, err := hdlrB.query().Info(context.Background(), &abcitypes.RequestInfo{}); err != errChainAppRetired {
+		t.Errorf("expected calls on retired chain app to fail: %v", err)
+	}
+	clientA.EXPECT().Info(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseInfo{LastBlockHeight: 2, LastBlockAppHash: []byte{0xa2}}, nil).Times(1)
+	if info, err := cosmux.Info(context.Background(), &abcitypes.RequestInfo{}); err != nil || info.LastBlockHeight != 2 {
+		t.Errorf("unexpected info with retired chain app: %v, %v", info, err)
+	}
+
+	// a node which was down at the last height of chainB exports it once on startup
+	restarted := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug", ExportDir: t.TempDir()},
+	)
+	clientRestarted := mocks.NewMockClient(mockCtrl)
+	clientRestarted.EXPECT().Query(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseQuery{Value: []byte(`{"state":"b2"}`), Height: 2}, nil).Times(1)
+	clientRestarted.EXPECT().IsRunning().Return(false).Times(1)
+	restarted.clients = map[ChainAppIdentifier]*AbciHandler{
+		idB: {ChainID: "chainB", ID: idB, client: clientRestarted, SunsetHeight: 3},
+	}
+	restarted.exportSunsetApps(5)
+	for i := 0; i < 100 && !restarted.clients[idB].retired.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	restarted.exportSunsetApps(6)
+
+	// transactions of chainB are rejected from the sunset height on
+	check, err := cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: txB})
+	if err != nil || check.Code != CodeChainAppInactive {
+		t.Errorf("expected CheckTx of retired chain app to be rejected: %v, %v", check, err)
+	}
+	proposal, err := cosmux.ProcessProposal(context.Background(), &abcitypes.RequestProcessProposal{Height: 3, Txs: [][]byte{txA, txB}})
+	if err != nil || proposal.Status != abcitypes.ResponseProcessProposal_REJECT {
+		t.Errorf("expected proposal with tx of retired chain app to be rejected: %v, %v", proposal, err)
+	}
+
+	// the final app hash of chainB stays in the composite app hash
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa3}}, nil).Times(1)
+	resp, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 3, Txs: [][]byte{txA}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if expected := compositeAppHash(map[ChainAppIdentifier][]byte{idA: {0xa3}, idB: {0xb2}}); !bytes.Equal(resp.AppHash, expected) {
+		t.Errorf("unexpected app hash after sunset: %X", resp.AppHash)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func signedControlTx(t *testing.T, key ed25519.PrivKey, network string, action string, chainID string, sequence uint64) []byte {
+	ctrl := &ControlTx{Action: action, ChainID: chainID, Sequence: sequence, PubKey: key.PubKey().Bytes()}
+	sig, err := key.Sign(ctrl.SignBytes(network))
+	if err != nil {
+		t.Fatalf("error signing control tx: %v", err)
+	}
+	ctrl.Signature = sig
+	tx, err := ctrl.Bytes()
+	if err != nil {
+		t.Fatalf("error encoding control tx: %v", err)
+	}
+	return tx
+}
+
+func TestPausedChainApp(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	txA, txB := append(createHeader("chainA"), 0xa0), append(createHeader("chainB"), 0xb0)
+	key := ed25519.GenPrivKey()
+	pause := signedControlTx(t, key, "megablocks", ControlActionPause, "chainB", 1)
+	resume := signedControlTx(t, key, "megablocks", ControlActionResume, "chainB", 2)
+
+	cosmux := NewMultiplexer(&CosmuxConfig{LogLevel: "debug"})
+	clientA := mocks.NewMockClient(mockCtrl)
+	clientB := mocks.NewMockClient(mockCtrl)
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: idB, client: clientB, pauses: cosmux.pauses}
+	hdlrB.translateConnections()
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA, client: clientA, pauses: cosmux.pauses},
+		idB: hdlrB,
+	}
+	appState := fmt.Sprintf(`{"control_keys":["%s"]}`, hex.EncodeToString(key.PubKey().Bytes()))
+	if err := cosmux.SetGenesis(&comettypes.GenesisDoc{ChainID: "megablocks", AppState: []byte(appState)}); err != nil {
+		t.Fatalf("error setting genesis: %v", err)
+	}
+
+	// the control tx at height 1 pauses chainB from height 2 on
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa1}}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb1}}, nil).Times(1)
+	clientA.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(3)
+	clientB.EXPECT().Commit(gomock.Any(), gomock.Any()).Return(&abcitypes.ResponseCommit{}, nil).Times(2)
+	resp, err := cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 1, Txs: [][]byte{txA, pause, txB}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if len(resp.TxResults) != 3 || resp.TxResults[1] == nil || resp.TxResults[1].Code != 0 {
+		t.Errorf("unexpected result of control tx: %v", resp.TxResults)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// transactions of chainB are rejected while it is paused
+	check, err := cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: txB})
+	if err != nil || check.Code != CodeChainAppPaused {
+		t.Errorf("expected CheckTx of paused chain app to be rejected: %v, %v", check, err)
+	}
+	proposal, err := cosmux.ProcessProposal(context.Background(), &abcitypes.RequestProcessProposal{Height: 2, Txs: [][]byte{txA, txB}})
+	if err != nil || proposal.Status != abcitypes.ResponseProcessProposal_REJECT {
+		t.Errorf("expected proposal with tx of paused chain app to be rejected: %v, %v", proposal, err)
+	}
+
+	// control txs must be signed by a control key and are not replayed
+	check, err = cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: pause})
+	if err != nil || check.Code != CodeInvalidControlTx {
+		t.Errorf("expected replayed control tx to be rejected: %v, %v", check, err)
+	}
+	unauthorized := signedControlTx(t, ed25519.GenPrivKey(), "megablocks", ControlActionResume, "chainB", 2)
+	proposal, err = cosmux.ProcessProposal(context.Background(), &abcitypes.RequestProcessProposal{Height: 2, Txs: [][]byte{unauthorized}})
+	if err != nil || proposal.Status != abcitypes.ResponseProcessProposal_REJECT {
+		t.Errorf("expected proposal with unauthorized control tx to be rejected: %v, %v", proposal, err)
+	}
+	otherNetwork := signedControlTx(t, key, "other-megablocks", ControlActionResume, "chainB", 2)
+	check, err = cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: otherNetwork})
+	if err != nil || check.Code != CodeInvalidControlTx {
+		t.Errorf("expected control tx signed for another network to be rejected: %v, %v", check, err)
+	}
+	check, err = cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: resume})
+	if err != nil || check.Code != 0 {
+		t.Errorf("expected CheckTx of resume to succeed: %v, %v", check, err)
+	}
+
+	// chainB is skipped and keeps its app hash, it is driven again from height 3 on
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa2}}, nil).Times(1)
+	resp, err = cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 2, Txs: [][]byte{txA, resume}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if expected := compositeAppHash(map[ChainAppIdentifier][]byte{idA: {0xa2}, idB: {0xb1}}); !bytes.Equal(resp.AppHash, expected) {
+		t.Errorf("unexpected app hash while paused: %X", resp.AppHash)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if !hdlrB.pausedAt(2) || hdlrB.pausedAt(3) {
+		t.Errorf("unexpected pause history of chainB")
+	}
+	check, err = cosmux.CheckTx(context.Background(), &abcitypes.RequestCheckTx{Tx: pause})
+	if err != nil || check.Code != CodeInvalidControlTx {
+		t.Errorf("expected replayed control tx to be rejected after resume: %v, %v", check, err)
+	}
+
+	// the paused height is not counted, chainB continues at its next height
+	clientA.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).Return(
+		&abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xa3}}, nil).Times(1)
+	clientB.EXPECT().FinalizeBlock(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+			if req.Height != 2 {
+				t.Errorf("expected chainB to finalize its height 2, got %d", req.Height)
+			}
+			return &abcitypes.ResponseFinalizeBlock{TxResults: []*abcitypes.ExecTxResult{{}}, AppHash: []byte{0xb3}}, nil
+		}).Times(1)
+	resp, err = cosmux.FinalizeBlock(context.Background(), &abcitypes.RequestFinalizeBlock{Height: 3, Txs: [][]byte{txA, txB}})
+	if err != nil {
+		t.Fatalf("FinalizeBlock failed: %v", err)
+	}
+	if expected := compositeAppHash(map[ChainAppIdentifier][]byte{idA: {0xa3}, idB: {0xb3}}); !bytes.Equal(resp.AppHash, expected) {
+		t.Errorf("unexpected app hash after resume: %X", resp.AppHash)
+	}
+	if _, err := cosmux.Commit(context.Background(), &abcitypes.RequestCommit{}); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if hdlrB.muxHeight(2) != 3 || hdlrB.drivenHeight(2) != 1 || hdlrB.drivenHeight(3) != 3 {
+		t.Errorf("unexpected heights of chainB: %d, %d, %d", hdlrB.muxHeight(2), hdlrB.drivenHeight(2), hdlrB.drivenHeight(3))
+	}
+
+	// scheduled pauses end at the resume height
+	scheduled := &AbciHandler{PauseHeight: 5, ResumeHeight: 7}
+	if scheduled.scheduledPauseAt(4) || !scheduled.scheduledPauseAt(5) || !scheduled.scheduledPauseAt(6) || scheduled.scheduledPauseAt(7) {
+		t.Errorf("unexpected scheduled pause")
+	}
+	if scheduled.appHeight(4) != 4 || scheduled.appHeight(7) != 5 || scheduled.muxHeight(4) != 4 || scheduled.muxHeight(5) != 7 {
+		t.Errorf("unexpected heights of scheduled pause")
+	}
+}
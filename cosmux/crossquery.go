@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// CrossQueryRequest is a read-only query of a chain app on the state of a sibling chain app
+type CrossQueryRequest struct {
+	// chain app issuing the query (optional)
+	Caller  string `json:"caller,omitempty"`
+	ChainID string `json:"chain_id"`
+	Path    string `json:"path"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// Gas charged for cross queries against the gas budget of the calling chain app
+const (
+	crossQueryBaseGas    = 1000 // per call
+	crossQueryGasPerByte = 1    // per byte of the request data and of the response value
+)
+
+// CrossQueryService serves synchronous read-only queries of chain apps on their siblings.
+// All reads are pinned to the last height committed by the multiplexer, so results are
+// the same on every node even when the query is issued during FinalizeBlock.
+//
+// Each call is charged gas for the bytes it moves against a budget of the calling chain app
+// per height, and fails once the budget is used up. The budget bounds the number and size of
+// the calls an app makes while executing a block. There is no time budget: a query answered on
+// one node and timed out on another would make block execution nondeterministic. The running
+// time of a single query is bounded by the sibling app, which serves it from committed state.
+type CrossQueryService struct {
+	mux      *CometMux
+	maxBytes int
+	maxGas   uint64
+	server   *http.Server
+
+	// gas used by each calling chain app at the pinned height
+	gasMtx    sync.Mutex
+	gasHeight int64
+	gasUsed   map[string]uint64
+}
+
+// NewCrossQueryService creates the query service for the given multiplexer
+func NewCrossQueryService(mux *CometMux) *CrossQueryService {
+	return &CrossQueryService{
+		mux:      mux,
+		maxBytes: mux.cfg.CrossQuery.MaxResponseBytes,
+		maxGas:   mux.cfg.CrossQuery.MaxGasPerBlock,
+		gasUsed:  map[string]uint64{},
+	}
+}
+
+// consumeGas charges gas to the caller at the given pinned height. It fails without charging
+// if the gas budget of the caller would be exceeded.
+func (svc *CrossQueryService) consumeGas(caller string, height int64, gas uint64) error {
+	if svc.maxGas == 0 {
+		return nil
+	}
+	svc.gasMtx.Lock()
+	defer svc.gasMtx.Unlock()
+	if height != svc.gasHeight {
+		svc.gasHeight = height
+		svc.gasUsed = map[string]uint64{}
+	}
+	if used := svc.gasUsed[caller]; used+gas > svc.maxGas {
+		return fmt.Errorf("cross query gas budget of '%s' exceeded: %d + %d > %d", caller, used, gas, svc.maxGas)
+	}
+	svc.gasUsed[caller] += gas
+	return nil
+}
+
+// CrossQuery forwards a query to the sibling chain app at the last committed height.
+// The call fails if the response exceeds the size budget or the caller runs out of gas.
+func (svc *CrossQueryService) CrossQuery(ctx context.Context, req *CrossQueryRequest) (*abcitypes.ResponseQuery, error) {
+	if req.Caller != "" && req.Caller == req.ChainID {
+		return nil, fmt.Errorf("cross query of '%s' on itself is not allowed", req.Caller)
+	}
+
+	hdlr, err := svc.mux.getHandlerFromChainId(req.ChainID)
+	if err != nil {
+		return nil, err
+	}
+
+	height := svc.mux.committedHeight.Load()
+	if height == 0 {
+		return nil, fmt.Errorf("no committed height available")
+	}
+
+	if err := svc.consumeGas(req.Caller, height, crossQueryBaseGas+crossQueryGasPerByte*uint64(len(req.Data))); err != nil {
+		return nil, err
+	}
+
+	query := &abcitypes.RequestQuery{
+		ChainId: req.ChainID,
+		Path:    req.Path,
+		Data:    req.Data,
+		Height:  height,
+	}
+	svc.mux.log.Debug("Forwarding cross query", "caller", req.Caller, "chain-id", req.ChainID, "height", height, "path", req.Path)
+	response, err := hdlr.query().Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("cross query on '%s' failed: %v", req.ChainID, err)
+	}
+	if svc.maxBytes > 0 && len(response.Value) > svc.maxBytes {
+		return nil, fmt.Errorf("cross query response exceeds budget: %d > %d bytes", len(response.Value), svc.maxBytes)
+	}
+	if err := svc.consumeGas(req.Caller, height, crossQueryGasPerByte*uint64(len(response.Value))); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// ServeHTTP handles cross queries posted as JSON encoded CrossQueryRequest
+func (svc *CrossQueryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := CrossQueryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response, err := svc.CrossQuery(r.Context(), &req)
+	if err != nil {
+		svc.mux.log.Error("cross query failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		svc.mux.log.Error("error writing cross query response", "error", err)
+	}
+}
+
+// Start serves cross queries on the given address
+func (svc *CrossQueryService) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error starting cross query service: %v", err)
+	}
+	svc.server = &http.Server{
+		Handler:           svc,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := svc.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			svc.mux.log.Error("cross query service stopped", "error", err)
+		}
+	}()
+	svc.mux.log.Info("Cross query service started", "address", address)
+	return nil
+}
+
+// Stop shuts the service down
+func (svc *CrossQueryService) Stop() error {
+	if svc.server == nil {
+		return nil
+	}
+	return svc.server.Close()
+}
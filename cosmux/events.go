@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// Event type and attributes used to tag events with the originating chain app. The event type
+// and the attribute prefix are reserved, copies emitted by chain apps are removed.
+const (
+	EventTypeMegablocks = "megablocks"
+	AttributeKeyChainID = "chain_id"
+	AttributeKeyAppID   = "app_id"
+)
+
+// chainEvent is added to each tx result, so the CometBFT indexer can filter transactions
+// by 'megablocks.chain_id' and 'megablocks.app_id'
+func chainEvent(hdlr *AbciHandler) abcitypes.Event {
+	return abcitypes.Event{
+		Type: EventTypeMegablocks,
+		Attributes: []abcitypes.EventAttribute{
+			{Key: AttributeKeyChainID, Value: hdlr.ChainID, Index: true},
+			{Key: AttributeKeyAppID, Value: hex.EncodeToString(hdlr.ID[:]), Index: true},
+		},
+	}
+}
+
+// chainAttributes returns the attributes identifying the chain app of a block event
+func chainAttributes(hdlr *AbciHandler) []abcitypes.EventAttribute {
+	return []abcitypes.EventAttribute{
+		{Key: EventTypeMegablocks + "." + AttributeKeyChainID, Value: hdlr.ChainID, Index: true},
+		{Key: EventTypeMegablocks + "." + AttributeKeyAppID, Value: hex.EncodeToString(hdlr.ID[:]), Index: true},
+	}
+}
+
+// isReservedAttribute returns true if the attribute key is reserved for the multiplexer
+func isReservedAttribute(attr abcitypes.EventAttribute) bool {
+	return strings.HasPrefix(attr.Key, EventTypeMegablocks+".")
+}
+
+// appEvents returns the events of a chain app without events of the reserved type and
+// reserved attributes, so a chain app cannot claim to be another one
+func appEvents(events []abcitypes.Event) []abcitypes.Event {
+	filtered := []abcitypes.Event{}
+	for _, event := range events {
+		if event.Type == EventTypeMegablocks {
+			continue
+		}
+		attributes := []abcitypes.EventAttribute{}
+		for _, attr := range event.Attributes {
+			if !isReservedAttribute(attr) {
+				attributes = append(attributes, attr)
+			}
+		}
+		event.Attributes = attributes
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+// tagEvents adds the attributes of the originating chain app to each block event of the chain app
+func tagEvents(events []abcitypes.Event, hdlr *AbciHandler) []abcitypes.Event {
+	tagged := appEvents(events)
+	for idx := range tagged {
+		tagged[idx].Attributes = append(tagged[idx].Attributes, chainAttributes(hdlr)...)
+	}
+	return tagged
+}
+
+// tagTxResult adds the event of the originating chain app to a tx result
+func tagTxResult(result *abcitypes.ExecTxResult, hdlr *AbciHandler) *abcitypes.ExecTxResult {
+	if result == nil {
+		return nil
+	}
+	tagged := *result
+	tagged.Events = append(appEvents(result.Events), chainEvent(hdlr))
+	return &tagged
+}
+
+// eventChainID returns the chain ID of the chain app a block event was tagged with
+func eventChainID(event abcitypes.Event) (string, bool) {
+	for _, attr := range event.Attributes {
+		if attr.Key == EventTypeMegablocks+"."+AttributeKeyChainID {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	comettypes "github.com/cometbft/cometbft/types"
+)
+
+// The schedule of the chain apps and the keys controlling them are part of the genesis of the
+// megablocks chain, so all nodes agree on them. They are read from 'app_state' of the CometBFT
+// genesis when the multiplexer starts.
+
+// MegablocksGenesis is the app state of the CometBFT genesis of a megablocks chain
+type MegablocksGenesis struct {
+	// heights from which on chain apps are retired, by chain ID
+	SunsetHeights map[string]int64 `json:"sunset_heights,omitempty"`
+	// hex encoded ed25519 public keys allowed to sign control transactions pausing and resuming
+	// chain apps, control transactions are rejected if empty
+	ControlKeys []string `json:"control_keys,omitempty"`
+	// scheduled pauses of chain apps, by chain ID
+	Pauses map[string]PauseSchedule `json:"pauses,omitempty"`
+}
+
+// PauseSchedule pauses a chain app from the pause height until the resume height
+type PauseSchedule struct {
+	PauseHeight  int64 `json:"pause_height"`
+	ResumeHeight int64 `json:"resume_height,omitempty"` // paused for good if 0
+}
+
+// SetGenesis applies the schedule of the megablocks genesis to the chain apps and their shadows
+func (mux *CometMux) SetGenesis(genesisDoc *comettypes.GenesisDoc) error {
+	genesis := MegablocksGenesis{}
+	if len(genesisDoc.AppState) > 0 {
+		if err := json.Unmarshal(genesisDoc.AppState, &genesis); err != nil {
+			return fmt.Errorf("invalid megablocks genesis: %v", err)
+		}
+	}
+	mux.network = genesisDoc.ChainID
+	mux.controlKeys = genesis.ControlKeys
+	for chainID, height := range genesis.SunsetHeights {
+		hdlr, err := mux.getHandlerFromChainId(chainID)
+		if err != nil {
+			return fmt.Errorf("sunset height of unknown chain app: %v", err)
+		}
+		hdlr.SunsetHeight = height
+		if shadow, exists := mux.shadows[hdlr.ID]; exists {
+			shadow.SunsetHeight = height
+		}
+	}
+	for chainID, pause := range genesis.Pauses {
+		hdlr, err := mux.getHandlerFromChainId(chainID)
+		if err != nil {
+			return fmt.Errorf("pause of unknown chain app: %v", err)
+		}
+		if pause.PauseHeight <= 0 || (pause.ResumeHeight != 0 && pause.ResumeHeight <= pause.PauseHeight) {
+			return fmt.Errorf("invalid pause of '%s' from height %d until %d", chainID, pause.PauseHeight, pause.ResumeHeight)
+		}
+		hdlr.PauseHeight, hdlr.ResumeHeight = pause.PauseHeight, pause.ResumeHeight
+		if shadow, exists := mux.shadows[hdlr.ID]; exists {
+			shadow.PauseHeight, shadow.ResumeHeight = pause.PauseHeight, pause.ResumeHeight
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	sm "github.com/cometbft/cometbft/state"
+)
+
+// ReplayLagging brings chain apps which restarted with an older state to the height of the
+// other chain apps. CometBFT's handshake only sees the single Info answer of the multiplexer,
+// so the missing blocks are taken from the block store and executed on the lagging chain
+// apps only, each receiving its own stripped transactions.
+func (mux *CometMux) ReplayLagging(ctx context.Context, blockStore sm.BlockStore, stateStore sm.Store) error {
+	heights := map[ChainAppIdentifier]int64{}
+	appHashes := map[ChainAppIdentifier][]byte{}
+	target := int64(0)
+	for id, hdlr := range mux.clients {
+		info, err := hdlr.query().Info(ctx, &abcitypes.RequestInfo{})
+		if err != nil {
+			return fmt.Errorf("error getting info of '%s': %v", hdlr.ChainID, err)
+		}
+		heights[id] = hdlr.lastHeight(info)
+		if info.LastBlockHeight == 0 {
+			// no state yet, a late joining chain app is at the height before its activation
+			continue
+		}
+		appHashes[id] = info.LastBlockAppHash
+		if info.LastBlockHeight > target {
+			target = info.LastBlockHeight
+		}
+	}
+	// chain apps ahead of the block store are left to CometBFT's handshake
+	if target > blockStore.Height() {
+		target = blockStore.Height()
+	}
+
+	from := target
+	for id, height := range heights {
+		hdlr := mux.clients[id]
+		// sparse chain apps are only behind if they missed a height they were driven at, replay
+		// drives them by the same rule as block execution, see skippedAt
+		if height >= hdlr.drivenHeight(target) || hdlr.sunsetAt(height+1) {
+			continue
+		}
+		if height == 0 {
+			return fmt.Errorf("chain app '%s' has no state and cannot be replayed to height %d", hdlr.ChainID, target)
+		}
+		if height+1 < blockStore.Base() {
+			return fmt.Errorf("chain app '%s' at height %d is below the block store base %d", hdlr.ChainID, height, blockStore.Base())
+		}
+		if height < from {
+			from = height
+		}
+	}
+	if from == target {
+		return nil
+	}
+
+	state, err := stateStore.Load()
+	if err != nil {
+		return fmt.Errorf("error loading state: %v", err)
+	}
+	mux.log.Info("Replaying blocks to lagging chain apps", "from", from+1, "to", target)
+	for height := from + 1; height <= target; height++ {
+		lagging := map[ChainAppIdentifier]bool{}
+		for id, appHeight := range heights {
+			if appHeight < height && mux.clients[id].activeAt(height) {
+				lagging[id] = true
+			}
+		}
+		results, err := mux.replayBlock(ctx, blockStore, stateStore, state.InitialHeight, height, lagging)
+		if err != nil {
+			return err
+		}
+		for _, resp := range results {
+			hdlr := mux.clients[resp.HandlerID]
+			if _, err := hdlr.consensus().Commit(ctx, &abcitypes.RequestCommit{}); err != nil {
+				return fmt.Errorf("error committing '%s' at height %d: %v", hdlr.ChainID, height, err)
+			}
+			appHashes[resp.HandlerID] = resp.Response.AppHash
+			mux.log.Info("Replayed block", "chain-id", hdlr.ChainID, "height", height)
+		}
+	}
+
+	mux.finalizedHeight = target
+	mux.stateMtx.Lock()
+	mux.appHashes = appHashes
+	mux.stateMtx.Unlock()
+	mux.committedHeight.Store(target)
+	return nil
+}
+
+// replayBlock executes the block at the given height from the block store on the lagging chain apps.
+// Results of the other chain apps are taken from the stored FinalizeBlock response.
+func (mux *CometMux) replayBlock(ctx context.Context, blockStore sm.BlockStore, stateStore sm.Store,
+	initialHeight int64, height int64, lagging map[ChainAppIdentifier]bool,
+) ([]FinalizeResponse, error) {
+	block := blockStore.LoadBlock(height)
+	if block == nil {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+	commitInfo := abcitypes.CommitInfo{}
+	if height > initialHeight {
+		lastValSet, err := stateStore.LoadValidators(height - 1)
+		if err != nil {
+			return nil, fmt.Errorf("error loading validators at height %d: %v", height-1, err)
+		}
+		if block.LastCommit.Size() != lastValSet.Size() {
+			return nil, fmt.Errorf("commit size %d does not match validator set size %d at height %d",
+				block.LastCommit.Size(), lastValSet.Size(), height)
+		}
+		commitInfo = sm.BuildLastCommitInfo(block, lastValSet, initialHeight)
+	}
+	req := &abcitypes.RequestFinalizeBlock{
+		Hash:               block.Hash(),
+		NextValidatorsHash: block.NextValidatorsHash,
+		ProposerAddress:    block.ProposerAddress,
+		Height:             block.Height,
+		Time:               block.Time,
+		DecidedLastCommit:  commitInfo,
+		Misbehavior:        block.Evidence.Evidence.ToABCI(),
+		Txs:                block.Txs.ToSliceOfBytes(),
+	}
+
+	// results of the other chain apps are only needed for conditional transactions depending on them
+	stored, err := stateStore.LoadFinalizeBlockResponse(height)
+	switch {
+	case err == nil:
+	case !mux.dependsOnOthers(req.Txs, lagging):
+		stored = &abcitypes.ResponseFinalizeBlock{}
+	case errors.Is(err, sm.ErrFinalizeBlockResponsesNotPersisted):
+		return nil, fmt.Errorf("block at height %d has conditional transactions on other chain apps, whose results "+
+			"are not stored with 'discard_abci_responses' enabled; replay on a node with 'discard_abci_responses = false'", height)
+	default:
+		return nil, fmt.Errorf("error loading results at height %d: %v", height, err)
+	}
+	txResults := make([]*abcitypes.ExecTxResult, len(req.Txs))
+	for idx, tx := range req.Txs {
+		if hdlr, err := mux.getHandler(tx); err == nil && !lagging[hdlr.ID] && idx < len(stored.TxResults) {
+			txResults[idx] = stored.TxResults[idx]
+		}
+	}
+
+	// sibling app hashes refer to the previous height
+	if mux.appHashStore != nil && height > initialHeight {
+		prevAppHashes := map[ChainAppIdentifier][]byte{}
+		for id := range mux.clients {
+			if hash, err := mux.appHashStore.Load(height-1, id); err == nil {
+				prevAppHashes[id] = hash
+			}
+		}
+		mux.stateMtx.Lock()
+		mux.appHashes = prevAppHashes
+		mux.stateMtx.Unlock()
+	}
+
+	results, err := mux.finalizeLagging(ctx, req, lagging, txResults)
+	if err != nil {
+		return nil, err
+	}
+	if mux.appHashStore != nil {
+		for _, resp := range results {
+			expected, err := mux.appHashStore.Load(height, resp.HandlerID)
+			if err == nil && string(expected) != string(resp.Response.AppHash) {
+				return nil, fmt.Errorf("app hash of '%s' at height %d is %X, expected %X",
+					mux.clients[resp.HandlerID].ChainID, height, resp.Response.AppHash, expected)
+			}
+		}
+	}
+	return results, nil
+}
+
+// dependsOnOthers returns true if a conditional transaction of a lagging chain app depends on
+// a transaction of a chain app which is not replayed
+func (mux *CometMux) dependsOnOthers(txs [][]byte, lagging map[ChainAppIdentifier]bool) bool {
+	for _, tx := range txs {
+		dependsOn := DependencyIndex(tx)
+		if dependsOn < 0 || dependsOn >= len(txs) {
+			continue
+		}
+		hdlr, err := mux.getHandler(tx)
+		if err != nil || !lagging[hdlr.ID] {
+			continue
+		}
+		if dependency, err := mux.getHandler(txs[dependsOn]); err == nil && !lagging[dependency.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+// finalizeLagging executes a block on the given chain apps only. txResults holds the results
+// of the other chain apps, so conditional transactions see the same dependencies.
+func (mux *CometMux) finalizeLagging(ctx context.Context, req *abcitypes.RequestFinalizeBlock,
+	lagging map[ChainAppIdentifier]bool, txResults []*abcitypes.ExecTxResult,
+) ([]FinalizeResponse, error) {
+	responseSlots, err := mux.responseSlots(req.Height, req.Txs)
+	if err != nil {
+		return nil, err
+	}
+	waves, _ := executionWaves(mapKeys(responseSlots), req.Txs)
+	results := []FinalizeResponse{}
+	for _, wave := range waves {
+		ids := []ChainAppIdentifier{}
+		for _, id := range wave {
+			if lagging[id] {
+				ids = append(ids, id)
+			}
+		}
+		waveResults, err := mux.finalizeWave(ctx, req, ids, responseSlots, txResults)
+		if err != nil {
+			return nil, err
+		}
+		for _, resp := range waveResults {
+			mux.placeTxResults(resp, txResults)
+		}
+		results = append(results, waveResults...)
+	}
+	return results, nil
+}
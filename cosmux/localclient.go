@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	abcicli "github.com/cometbft/cometbft/abci/client"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/libs/service"
+	"github.com/cometbft/cometbft/proxy"
+)
+
+// Modes of the local client between CometBFT and the multiplexer
+const (
+	// ClientModeConnSync serializes the calls of each CometBFT connection
+	ClientModeConnSync = "conn_sync"
+	// ClientModeConcurrent passes calls concurrently to the multiplexer which
+	// serializes them per chain app and connection
+	ClientModeConcurrent = "concurrent"
+)
+
+// NewLocalClientCreator returns the client creator of the given mode for the multiplexer
+func NewLocalClientCreator(mux *CometMux, mode string) (proxy.ClientCreator, error) {
+	switch mode {
+	case "", ClientModeConnSync:
+		return proxy.NewConnSyncLocalClientCreator(mux), nil
+	case ClientModeConcurrent:
+		return &concurrentClientCreator{app: mux}, nil
+	}
+	return nil, fmt.Errorf("unknown client mode '%s'", mode)
+}
+
+type concurrentClientCreator struct {
+	app abcitypes.Application
+}
+
+func (c *concurrentClientCreator) NewABCIClient() (abcicli.Client, error) {
+	cli := &concurrentClient{Application: c.app}
+	cli.BaseService = *service.NewBaseService(nil, "concurrentClient", cli)
+	return cli, nil
+}
+
+// concurrentClient is a local client which does not serialize the calls to the application
+type concurrentClient struct {
+	service.BaseService
+	abcitypes.Application
+
+	mtx      sync.Mutex
+	callback abcicli.Callback
+}
+
+var _ abcicli.Client = (*concurrentClient)(nil)
+
+func (app *concurrentClient) SetResponseCallback(cb abcicli.Callback) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	app.callback = cb
+}
+
+func (app *concurrentClient) CheckTxAsync(ctx context.Context, req *abcitypes.RequestCheckTx) (*abcicli.ReqRes, error) {
+	res, err := app.Application.CheckTx(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	request, response := abcitypes.ToRequestCheckTx(req), abcitypes.ToResponseCheckTx(res)
+
+	app.mtx.Lock()
+	callback := app.callback
+	app.mtx.Unlock()
+	if callback != nil {
+		callback(request, response)
+	}
+
+	reqRes := abcicli.NewReqRes(request)
+	reqRes.Response = response
+	// marks the request as done, a callback set later is invoked immediately
+	reqRes.InvokeCallback()
+	return reqRes, nil
+}
+
+func (app *concurrentClient) Error() error {
+	return nil
+}
+
+func (app *concurrentClient) Flush(context.Context) error {
+	return nil
+}
+
+func (app *concurrentClient) Echo(_ context.Context, msg string) (*abcitypes.ResponseEcho, error) {
+	return &abcitypes.ResponseEcho{Message: msg}, nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	cfg "github.com/cometbft/cometbft/config"
@@ -13,7 +18,10 @@ import (
 	"github.com/cometbft/cometbft/node"
 	"github.com/cometbft/cometbft/p2p"
 	"github.com/cometbft/cometbft/privval"
-	"github.com/cometbft/cometbft/proxy"
+	rpchttp "github.com/cometbft/cometbft/rpc/client/http"
+	sm "github.com/cometbft/cometbft/state"
+	"github.com/cometbft/cometbft/store"
+	comettypes "github.com/cometbft/cometbft/types"
 )
 
 var (
@@ -25,10 +33,15 @@ var (
 
 type MegaBlockApp struct {
 	//ID             uint8  // app identifier used to route tx
-	Address        string //`mapstructure:"address"`
-	ConnectionType string //`mapstructure:"connection_type"`
-	ChainID        string //`mapstructure:"chain_id"`
-	Home           string //`mapstructure:"home"`
+	Address          string   //`mapstructure:"address"`
+	ConnectionType   string   //`mapstructure:"connection_type"`
+	ChainID          string   //`mapstructure:"chain_id"`
+	Home             string   //`mapstructure:"home"`
+	SiblingHashes    bool     //`mapstructure:"sibling_hashes"`
+	Shadow           bool     //`mapstructure:"shadow"` shadow of the chain app with the same chain ID
+	Replicas         []string //`mapstructure:"replicas"` addresses of read-only replicas serving queries
+	ActivationHeight int64    //`mapstructure:"activation_height"` height a chain app joining a running chain starts at
+	Sparse           bool     //`mapstructure:"sparse"` drive the chain app only on heights with its transactions
 }
 
 // ChainApps is a list of applications handled by Multiplexer
@@ -78,11 +91,116 @@ func main() {
 		muxCfg.LogLevel = "debug"
 	}
 
+	if muxCfg.ExportDir == "" {
+		muxCfg.ExportDir = filepath.Join(cometCfg.DBDir(), "megablocks_export")
+	}
+
+	// Rebuild the state of a single chain app instead of running the node
+	if flag.Arg(0) == "replay" {
+		if err := runReplay(cometCfg, muxCfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("error replaying chain app: %v", err)
+		}
+		return
+	}
+	// Print the mempool breakdown by chain app of a running node
+	if flag.Arg(0) == "mempool" {
+		if err := runMempool(cometCfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("error querying mempool: %v", err)
+		}
+		return
+	}
+
 	// Create Multiplexer Shim
 	cosmux := NewMultiplexer(muxCfg)
+	if cometCfg.Instrumentation.Prometheus {
+		cosmux.SetMetrics(PrometheusMetrics(cometCfg.Instrumentation.Namespace))
+	}
+	genesis, err := comettypes.GenesisDocFromFile(cometCfg.GenesisFile())
+	if err != nil {
+		log.Fatalf("error loading genesis: %v", err)
+	}
+	if err := cosmux.SetGenesis(genesis); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := cosmux.Start(); err != nil {
 		log.Fatalf("error starting cosmux; %v", err)
 	}
+	if err := cosmux.CheckCapabilities(context.Background()); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Index outer and inner hashes of all routed transactions
+	txIndexDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_tx_index", Config: cometCfg})
+	if err != nil {
+		log.Fatalf("error opening tx hash index: %v", err)
+	}
+	defer txIndexDB.Close()
+	cosmux.SetTxHashIndex(NewTxHashIndex(txIndexDB))
+
+	// Record app hashes of all chain apps per height
+	appHashDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_app_hash", Config: cometCfg})
+	if err != nil {
+		log.Fatalf("error opening app hash store: %v", err)
+	}
+	defer appHashDB.Close()
+	cosmux.SetAppHashStore(NewAppHashStore(appHashDB))
+
+	// Map the heights of sparse chain apps to the heights of the chain
+	sparseDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_sparse_heights", Config: cometCfg})
+	if err != nil {
+		log.Fatalf("error opening sparse height store: %v", err)
+	}
+	defer sparseDB.Close()
+	if err := cosmux.SetSparseHeightStore(sparseDB); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Record chain apps paused and resumed by control transactions
+	pauseDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_pauses", Config: cometCfg})
+	if err != nil {
+		log.Fatalf("error opening pause store: %v", err)
+	}
+	defer pauseDB.Close()
+	if err := cosmux.SetPauseStore(pauseDB); err != nil {
+		log.Fatalf("error loading pause changes: %v", err)
+	}
+
+	// Record the activations of late joining chain apps
+	activationDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_activations", Config: cometCfg})
+	if err != nil {
+		log.Fatalf("error opening activation store: %v", err)
+	}
+	defer activationDB.Close()
+	if err := cosmux.SetActivationStore(activationDB); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// Finish a height interrupted by a crash before CometBFT starts its handshake
+	walDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_wal", Config: cometCfg})
+	if err != nil {
+		log.Fatalf("error opening WAL: %v", err)
+	}
+	defer walDB.Close()
+	cosmux.SetWAL(NewWAL(walDB))
+	if err := cosmux.Recover(context.Background()); err != nil {
+		log.Fatalf("error recovering from WAL: %v", err)
+	}
+
+	// Bring chain apps restarted with an older state to the height of the others
+	if err := replayLagging(cosmux, cometCfg); err != nil {
+		log.Fatalf("error replaying blocks to lagging chain apps: %v", err)
+	}
+	// Export retired chain apps missed while the node was down
+	cosmux.exportSunsetApps(cosmux.committedHeight.Load())
+
+	// Serve read-only queries of chain apps on their siblings
+	if muxCfg.CrossQuery.Address != "" {
+		crossQuery := NewCrossQueryService(cosmux)
+		if err := crossQuery.Start(muxCfg.CrossQuery.Address); err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer crossQuery.Stop()
+	}
 
 	// use private validator to sign consensus messages
 	pv := privval.LoadFilePV(
@@ -102,7 +220,10 @@ func main() {
 		log.Fatalf("failed to parse log level: %v", err)
 	}
 
-	clientCreator := proxy.NewConnSyncLocalClientCreator(cosmux)
+	clientCreator, err := NewLocalClientCreator(cosmux, muxCfg.ClientMode)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	node, err := node.NewNode(
 		cometCfg,
 		pv,
@@ -117,6 +238,31 @@ func main() {
 		log.Fatalf("error creating node: %v", err)
 	}
 
+	// Track the pending transactions of the mempool by chain app
+	cosmux.SetMempool(node.Mempool())
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	defer stopPruning()
+	go cosmux.PruneMempoolTracker(pruneCtx, mempoolPruneInterval)
+
+	// Serve the CometBFT RPC per chain app
+	if muxCfg.RPCProxy.Address != "" {
+		rpcProxy, err := NewRPCProxy(cosmux, cometCfg.RPC.ListenAddress)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		env, err := node.ConfigureRPC()
+		if err != nil {
+			log.Fatalf("error configuring RPC environment: %v", err)
+		}
+		rpcProxy.SetChainViews(NewChainViews(cosmux, env.BlockStore, env.StateStore))
+		rpcProxy.SetChainEvents(NewChainEvents(cosmux, env.EventBus))
+		rpcProxy.SetMempool(env.Mempool)
+		if err := rpcProxy.Start(muxCfg.RPCProxy.Address); err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer rpcProxy.Stop()
+	}
+
 	node.Start()
 	defer func() {
 		node.Stop()
@@ -127,3 +273,138 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 }
+
+// runMempool prints the mempool breakdown by chain app, queried over the CometBFT RPC of a running node
+func runMempool(cometCfg *cfg.Config, args []string) error {
+	flags := flag.NewFlagSet("mempool", flag.ExitOnError)
+	address := flags.String("rpc", cometCfg.RPC.ListenAddress, "CometBFT RPC address of the node")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client, err := rpchttp.New(*address, "/websocket")
+	if err != nil {
+		return err
+	}
+	result, err := client.ABCIQuery(context.Background(), QueryPathMempool, nil)
+	if err != nil {
+		return err
+	}
+	if !result.Response.IsOK() {
+		return fmt.Errorf("%s", result.Response.Log)
+	}
+	out := bytes.Buffer{}
+	if err := json.Indent(&out, result.Response.Value, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+// replayLagging opens the block and state store of CometBFT for the startup handshake of the
+// multiplexer. The stores are closed again before the node opens them.
+func replayLagging(cosmux *CometMux, cometCfg *cfg.Config) error {
+	blockStoreDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "blockstore", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer blockStoreDB.Close()
+	stateDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "state", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer stateDB.Close()
+
+	stateStore := sm.NewStore(stateDB, sm.StoreOptions{
+		DiscardABCIResponses: cometCfg.Storage.DiscardABCIResponses,
+	})
+	return cosmux.ReplayLagging(context.Background(), store.NewBlockStore(blockStoreDB), stateStore)
+}
+
+// runReplay executes the 'replay' command. It rebuilds the state of a single chain app from the
+// block store of a stopped node.
+func runReplay(cometCfg *cfg.Config, muxCfg *CosmuxConfig, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	chainID := flags.String("chain-id", "", "chain ID of the chain app to rebuild")
+	from := flags.Int64("from", 0, "first height to replay, the chain app must be at the height before (0 replays from genesis)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *chainID == "" {
+		return fmt.Errorf("chain ID of the chain app required")
+	}
+
+	cosmux := NewMultiplexer(muxCfg)
+	hdlr, err := cosmux.getHandlerFromChainId(*chainID)
+	if err != nil {
+		return err
+	}
+	if err := hdlr.Connect(); err != nil {
+		return err
+	}
+
+	genesis, err := comettypes.GenesisDocFromFile(cometCfg.GenesisFile())
+	if err != nil {
+		return fmt.Errorf("error loading genesis: %v", err)
+	}
+	if err := cosmux.SetGenesis(genesis); err != nil {
+		return err
+	}
+	appHashDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_app_hash", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer appHashDB.Close()
+	cosmux.SetAppHashStore(NewAppHashStore(appHashDB))
+	sparseDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_sparse_heights", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer sparseDB.Close()
+	if err := cosmux.SetSparseHeightStore(sparseDB); err != nil {
+		return err
+	}
+	pauseDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_pauses", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer pauseDB.Close()
+	if err := cosmux.SetPauseStore(pauseDB); err != nil {
+		return err
+	}
+	activationDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "megablocks_activations", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer activationDB.Close()
+	if err := cosmux.SetActivationStore(activationDB); err != nil {
+		return err
+	}
+	blockStoreDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "blockstore", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer blockStoreDB.Close()
+	stateDB, err := cfg.DefaultDBProvider(&cfg.DBContext{ID: "state", Config: cometCfg})
+	if err != nil {
+		return err
+	}
+	defer stateDB.Close()
+
+	stateStore := sm.NewStore(stateDB, sm.StoreOptions{
+		DiscardABCIResponses: cometCfg.Storage.DiscardABCIResponses,
+	})
+	blockStore := store.NewBlockStore(blockStoreDB)
+	if err := cosmux.RebuildChainApp(context.Background(), *chainID, *from, blockStore, stateStore, genesis); err != nil {
+		return err
+	}
+
+	// a retired chain app rebuilt up to its last height is exported unless done before
+	last := hdlr.lastActiveHeight()
+	if last == 0 || last > blockStore.Height() {
+		return nil
+	}
+	if _, err := os.Stat(cosmux.exportFile(hdlr, last)); err == nil {
+		return nil
+	}
+	return cosmux.ExportChainApp(context.Background(), hdlr, last)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	comettypes "github.com/cometbft/cometbft/types"
+)
+
+// MempoolStatsPath is the path of the mempool breakdown served by the RPC proxy
+const MempoolStatsPath = "/megablocks/mempool"
+
+// QueryPathMempool is the ABCI query path of the mempool breakdown
+const QueryPathMempool = MempoolStatsPath
+
+// Transactions which left the mempool without being included or rejected, e.g. evicted, are
+// dropped from the tracker in the prune interval. Transactions seen within the grace period are
+// kept, as they may be accepted by CheckTx but not yet added to the mempool.
+const (
+	mempoolPruneInterval = time.Minute
+	mempoolPruneGrace    = 10 * time.Second
+)
+
+// MempoolReader gives access to the pending transactions of the CometBFT mempool
+type MempoolReader interface {
+	ReapMaxTxs(max int) comettypes.Txs
+}
+
+// AppMempoolStats are the mempool statistics of a single chain app
+type AppMempoolStats struct {
+	ChainID         string  `json:"chain_id"`
+	AppID           string  `json:"app_id"`
+	PendingTxs      int     `json:"pending_txs"`
+	PendingBytes    int64   `json:"pending_bytes"`
+	OldestAgeSecs   float64 `json:"oldest_age_secs"`
+	CheckTxAccepted uint64  `json:"check_tx_accepted"`
+	CheckTxRejected uint64  `json:"check_tx_rejected"`
+	RecheckRejected uint64  `json:"recheck_rejected"`
+}
+
+type checkTxCounters struct {
+	accepted, rejected, recheckRejected uint64
+}
+
+// MempoolTracker records when transactions entered the mempool and the outcome of CheckTx per chain app
+type MempoolTracker struct {
+	mtx       sync.Mutex
+	firstSeen map[string]time.Time
+	counters  map[ChainAppIdentifier]*checkTxCounters
+}
+
+// NewMempoolTracker creates an empty tracker
+func NewMempoolTracker() *MempoolTracker {
+	return &MempoolTracker{
+		firstSeen: map[string]time.Time{},
+		counters:  map[ChainAppIdentifier]*checkTxCounters{},
+	}
+}
+
+// RecordCheckTx records the result of CheckTx of a transaction including the Megablocks header
+func (t *MempoolTracker) RecordCheckTx(id ChainAppIdentifier, tx []byte, checkType abcitypes.CheckTxType, accepted bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	counters, exists := t.counters[id]
+	if !exists {
+		counters = &checkTxCounters{}
+		t.counters[id] = counters
+	}
+	key := string(comettypes.Tx(tx).Hash())
+	switch {
+	case accepted && checkType == abcitypes.CheckTxType_New:
+		counters.accepted++
+		if _, seen := t.firstSeen[key]; !seen {
+			t.firstSeen[key] = time.Now()
+		}
+	case !accepted && checkType == abcitypes.CheckTxType_Recheck:
+		counters.recheckRejected++
+	case !accepted:
+		counters.rejected++
+	}
+	// rejected transactions are not or no longer in the mempool
+	if !accepted {
+		delete(t.firstSeen, key)
+	}
+}
+
+// RemoveTxs drops transactions included in a block
+func (t *MempoolTracker) RemoveTxs(txs [][]byte) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, tx := range txs {
+		delete(t.firstSeen, string(comettypes.Tx(tx).Hash()))
+	}
+}
+
+// prune drops all transactions seen before the given time which are not pending any more
+func (t *MempoolTracker) prune(pending comettypes.Txs, before time.Time) {
+	keep := make(map[string]bool, len(pending))
+	for _, tx := range pending {
+		keep[string(tx.Hash())] = true
+	}
+	for key, seen := range t.firstSeen {
+		if !keep[key] && seen.Before(before) {
+			delete(t.firstSeen, key)
+		}
+	}
+}
+
+// SetMempool gives the multiplexer access to the CometBFT mempool for the mempool breakdown
+func (mux *CometMux) SetMempool(mempool MempoolReader) {
+	mux.mempool = mempool
+}
+
+// PruneMempoolTracker drops transactions which left the mempool from the tracker until the context is done
+func (mux *CometMux) PruneMempoolTracker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// the mempool is read before locking the tracker, see MempoolStats
+			before := time.Now().Add(-mempoolPruneGrace)
+			pending := mux.mempool.ReapMaxTxs(-1)
+			mux.mempoolTracker.mtx.Lock()
+			mux.mempoolTracker.prune(pending, before)
+			mux.mempoolTracker.mtx.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// queryMempool answers queries on QueryPathMempool
+func (mux *CometMux) queryMempool() *abcitypes.ResponseQuery {
+	if mux.mempool == nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: "mempool not available"}
+	}
+	value, err := json.Marshal(mux.MempoolStats(mux.mempool))
+	if err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	return &abcitypes.ResponseQuery{Value: value}
+}
+
+// MempoolStats groups the pending transactions of the mempool by chain app
+func (mux *CometMux) MempoolStats(mempool MempoolReader) []AppMempoolStats {
+	now := time.Now()
+	stats := map[ChainAppIdentifier]*AppMempoolStats{}
+	for id, hdlr := range mux.clients {
+		stats[id] = &AppMempoolStats{ChainID: hdlr.ChainID, AppID: hex.EncodeToString(id[:])}
+	}
+
+	// the mempool is read before locking the tracker, as CometBFT calls CheckTx and
+	// thereby the tracker while holding the lock of the mempool
+	txs := mempool.ReapMaxTxs(-1)
+
+	t := mux.mempoolTracker
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.prune(txs, now.Add(-mempoolPruneGrace))
+
+	for _, tx := range txs {
+		hdlr, err := mux.getHandler(tx)
+		if err != nil {
+			continue
+		}
+		appStats := stats[hdlr.ID]
+		appStats.PendingTxs++
+		appStats.PendingBytes += int64(len(tx))
+		if seen, exists := t.firstSeen[string(tx.Hash())]; exists {
+			if age := now.Sub(seen).Seconds(); age > appStats.OldestAgeSecs {
+				appStats.OldestAgeSecs = age
+			}
+		}
+	}
+	for id, counters := range t.counters {
+		if appStats, exists := stats[id]; exists {
+			appStats.CheckTxAccepted = counters.accepted
+			appStats.CheckTxRejected = counters.rejected
+			appStats.RecheckRejected = counters.recheckRejected
+		}
+	}
+
+	result := []AppMempoolStats{}
+	for _, appStats := range stats {
+		result = append(result, *appStats)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ChainID < result[j].ChainID })
+	return result
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsSubsystem is the subsystem label of the multiplexer metrics
+const MetricsSubsystem = "megablocks"
+
+// Metrics of the multiplexer
+type Metrics struct {
+	// Number of divergences of shadow chain apps from their primary.
+	// Labels: chain_id, kind (tx_result, app_hash, error)
+	ShadowDivergences metrics.Counter
+	// Number of calls queued for a shadow chain app, i.e. how far it lags behind its primary.
+	// Labels: chain_id
+	ShadowQueuedCalls metrics.Gauge
+	// 1 if a shadow chain app fell too far behind its primary and was stopped.
+	// Labels: chain_id
+	ShadowStopped metrics.Gauge
+}
+
+// PrometheusMetrics returns metrics registered with the default Prometheus registry
+// which is served by CometBFT if instrumentation is enabled
+func PrometheusMetrics(namespace string) *Metrics {
+	return &Metrics{
+		ShadowDivergences: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "shadow_divergences",
+			Help:      "Number of divergences of shadow chain apps from their primary.",
+		}, []string{"chain_id", "kind"}),
+		ShadowQueuedCalls: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "shadow_queued_calls",
+			Help:      "Number of calls queued for a shadow chain app.",
+		}, []string{"chain_id"}),
+		ShadowStopped: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "shadow_stopped",
+			Help:      "1 if a shadow chain app fell too far behind its primary and was stopped.",
+		}, []string{"chain_id"}),
+	}
+}
+
+// NopMetrics returns metrics which are discarded
+func NopMetrics() *Metrics {
+	return &Metrics{
+		ShadowDivergences: discard.NewCounter(),
+		ShadowQueuedCalls: discard.NewGauge(),
+		ShadowStopped:     discard.NewGauge(),
+	}
+}
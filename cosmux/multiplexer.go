@@ -9,6 +9,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"cosmossdk.io/api/tendermint/abci"
 	abcicli "github.com/cometbft/cometbft/abci/client"
@@ -29,6 +30,17 @@ var (
 
 type ChainAppIdentifier [4]byte
 
+// GetChainAppIdentifier returns the identifier of a chain app used in the Megablocks header
+func GetChainAppIdentifier(chainID string) ChainAppIdentifier {
+	sha1Sum := sha1.Sum([]byte(chainID))
+	return ChainAppIdentifier(sha1Sum[:ChainAppIdLen])
+}
+
+// CreateHeader creates the Megablocks header for transactions of the given chain app
+func CreateHeader(appID ChainAppIdentifier) []byte {
+	return append(append([]byte{}, MAGIC[:]...), appID[:]...)
+}
+
 type appIdStorter struct {
 	identifiers []ChainAppIdentifier
 }
@@ -67,15 +79,73 @@ type CometMux struct {
 	log     cmtlog.Logger
 	clients map[ChainAppIdentifier]*AbciHandler
 	cfg     *CosmuxConfig
+
+	// height of the last block finalized and committed by all chain apps
+	finalizedHeight int64
+	committedHeight atomic.Int64
+
+	// app hashes of the chain apps at the last finalized height,
+	// guarded as Info is called on the query connection
+	appHashes map[ChainAppIdentifier][]byte
+	stateMtx  sync.RWMutex
+
+	// optional index of outer to inner tx hashes
+	txIndex *TxHashIndex
+	// optional store of the app hashes of all chain apps per height
+	appHashStore *AppHashStore
+	// optional write-ahead log of the progress of the last height
+	wal *WAL
+
+	// age and CheckTx outcome of the transactions in the mempool
+	mempoolTracker *MempoolTracker
+	// pending transactions of the CometBFT mempool, if available
+	mempool MempoolReader
+	// retired chain apps whose state is being exported
+	exports sync.Map
+	// earlier CheckTx results answering rechecks of unchanged chain apps
+	recheckCache *RecheckCache
+
+	// sparse chain apps not driven at the finalized height
+	skippedApps map[ChainAppIdentifier]bool
+
+	// chain apps paused and resumed by control transactions and
+	// the changes of the finalized height recorded on commit
+	pauses        *PauseControl
+	pendingPauses map[ChainAppIdentifier][]PauseChange
+	// chain ID of the megablocks chain and the keys allowed to sign control transactions, set by the genesis
+	network     string
+	controlKeys []string
+
+	// optimistic execution of the last accepted proposal
+	optimistic *optimisticExecution
+
+	// shadow chain apps receiving the traffic of a primary without reaching consensus
+	shadows map[ChainAppIdentifier]*shadowRunner
+	metrics *Metrics
 }
 
 type AbciHandler struct {
 	ID                ChainAppIdentifier // unique application identifier
 	ChainID           string
-	client            abcicli.Client
+	client            abcicli.Client // consensus connection
+	mempoolConn       abcicli.Client
+	queryConn         abcicli.Client
 	logLevel          string
 	InitAppStateBytes []byte
 	InitValidators    []byte
+	SiblingHashes     bool              // deliver app hashes of sibling apps at the start of each block
+	replicas          *ReplicaSet       // optional read replicas serving queries
+	ActivationHeight  int64             // height a chain app joining a running chain is initialized at
+	activation        *activationRecord // InitChain response of a late joining chain app once activated
+	sparse            *SparseHeights    // heights of a chain app only driven on heights with its transactions
+	SunsetHeight      int64             // height from which on a retired chain app is no longer driven, set by the genesis
+	retired           atomic.Bool       // set when the connections are closed after the last height was committed and exported
+	PauseHeight       int64             // height from which on the chain app is paused, set by the genesis
+	ResumeHeight      int64             // height a chain app paused by the genesis is driven again
+	pauses            *PauseControl     // pauses of the chain app made by control transactions
+
+	// calls of each connection are serialized per chain app
+	consensusMtx, mempoolMtx, queryMtx sync.Mutex
 }
 
 // Connect creates the client and connects to the chain application
@@ -86,17 +156,21 @@ func (hdl *AbciHandler) Connect() error {
 	if err != nil {
 		return err
 	}
-	hdl.client.SetLogger(logger)
-
-	// Start client
-	if hdl.client.IsRunning() {
-		logger.Info("Client already running")
-		return nil
-	}
-
-	if err := hdl.client.Start(); err != nil {
-		return fmt.Errorf("error starting client %d: %v", hdl.ID, err.Error())
+	// Start clients
+	for name, conn := range hdl.connections() {
+		conn.SetLogger(logger.With("connection", name))
+		if conn.IsRunning() {
+			logger.Info("Client already running", "connection", name)
+			continue
+		}
+		if err := conn.Start(); err != nil {
+			return fmt.Errorf("error starting %s client %d: %v", name, hdl.ID, err.Error())
+		}
 	}
+	hdl.replicas.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), replicaRefreshTimeout)
+	defer cancel()
+	hdl.replicas.Refresh(ctx)
 
 	logger.Info("Connected")
 	return nil
@@ -108,7 +182,7 @@ func (hdl *AbciHandler) InitChain(ctx context.Context, chain *abcitypes.RequestI
 	req.AppStateBytes = hdl.InitAppStateBytes
 	// TBD: Decide validator setup for multi-chain.
 	//      In this spike it's not an app specific setting but a multiplexer
-	return hdl.client.InitChain(ctx, &req)
+	return hdl.consensus().InitChain(ctx, &req)
 }
 
 // Check API compliance
@@ -122,9 +196,16 @@ func NewMultiplexer(config *CosmuxConfig) *CometMux {
 		log.Fatalf("failed to parse log level: %v", err)
 	}
 	m := CometMux{
-		log:     logger,
-		clients: map[ChainAppIdentifier]*AbciHandler{},
-		cfg:     config,
+		log:       logger,
+		clients:   map[ChainAppIdentifier]*AbciHandler{},
+		cfg:       config,
+		appHashes: map[ChainAppIdentifier][]byte{},
+
+		mempoolTracker: NewMempoolTracker(),
+		recheckCache:   NewRecheckCache(),
+		pauses:         NewPauseControl(),
+		shadows:        map[ChainAppIdentifier]*shadowRunner{},
+		metrics:        NopMetrics(),
 	}
 
 	// Register applications
@@ -139,35 +220,70 @@ func NewMultiplexer(config *CosmuxConfig) *CometMux {
 
 // AddApplication adds a chain application to the multiplexer
 func (mux *CometMux) AddApplication(app MegaBlockApp) error {
-	sha1Sum := sha1.Sum([]byte(app.ChainID))
-	appId := ChainAppIdentifier(sha1Sum[:5])
+	appId := GetChainAppIdentifier(app.ChainID)
 
-	_, exists := mux.clients[appId]
-	if exists {
-		log.Fatal("handler exists already with ID", appId)
-	} else {
-		mux.log.Info(fmt.Sprintf("Adding handler for %s= %v", app.ChainID, appId))
-	}
-	client, err := proxy.NewRemoteClientCreator(app.Address, app.ConnectionType, true).NewABCIClient()
-	if err != nil {
-		return err
+	if !app.Shadow {
+		_, exists := mux.clients[appId]
+		if exists {
+			log.Fatal("handler exists already with ID", appId)
+		} else {
+			mux.log.Info(fmt.Sprintf("Adding handler for %s= %v", app.ChainID, appId))
+		}
 	}
-
 	var appState = []byte{}
+	var err error
 	if appState, err = GetInitialAppState(app.Home); err != nil {
 		log.Fatalf("Error reading app state for '%s': %v", app.ChainID, err)
 	}
 
-	mux.clients[appId] = &AbciHandler{
+	hdlr := &AbciHandler{
 		ID:                appId,
 		ChainID:           app.ChainID,
-		client:            client,
 		logLevel:          mux.cfg.LogLevel,
 		InitAppStateBytes: appState,
+		SiblingHashes:     app.SiblingHashes,
+		ActivationHeight:  app.ActivationHeight,
+		pauses:            mux.pauses,
+	}
+	if app.Sparse {
+		hdlr.sparse = NewSparseHeights(appId)
+	}
+	if hdlr.lateJoining() {
+		hdlr.activation = newActivationRecord(appId, app.Shadow)
 	}
+	if err := connectChainApp(hdlr, app.Address, app.ConnectionType); err != nil {
+		return err
+	}
+	hdlr.translateConnections()
+	if app.Shadow {
+		return mux.addShadow(hdlr)
+	}
+
+	replicas := []*Replica{}
+	for _, address := range app.Replicas {
+		replicaClient, err := proxy.NewRemoteClientCreator(address, app.ConnectionType, true).NewABCIClient()
+		if err != nil {
+			return fmt.Errorf("error creating replica client '%s': %v", address, err)
+		}
+		replicas = append(replicas, &Replica{Address: address, client: hdlr.translateHeights(replicaClient)})
+	}
+	if len(replicas) > 0 {
+		hdlr.replicas = NewReplicaSet(mux.log.With("chain-id", app.ChainID), replicas...)
+	}
+	mux.clients[appId] = hdlr
 	return nil
 }
 
+// SetTxHashIndex enables indexing of the hashes of all routed transactions
+func (mux *CometMux) SetTxHashIndex(idx *TxHashIndex) {
+	mux.txIndex = idx
+}
+
+// SetAppHashStore enables recording of the app hashes of all chain apps per height
+func (mux *CometMux) SetAppHashStore(store *AppHashStore) {
+	mux.appHashStore = store
+}
+
 // Start connects to all registered applications
 func (mux *CometMux) Start() error {
 	for _, client := range mux.clients {
@@ -175,6 +291,11 @@ func (mux *CometMux) Start() error {
 			return fmt.Errorf("error connecting to chain app %d: %v", client.ID, err)
 		}
 	}
+	for _, shadow := range mux.shadows {
+		if err := shadow.Connect(); err != nil {
+			return fmt.Errorf("error connecting to shadow of chain app %s: %v", shadow.ChainID, err)
+		}
+	}
 	return nil
 }
 
@@ -208,6 +329,12 @@ func CheckHeader(tx []byte) error {
 		return fmt.Errorf("invalid tx header length: %d", len(tx))
 	}
 	// check Magic
+	if bytes.Equal(tx[:len(CondMAGIC)], CondMAGIC[:]) {
+		if len(tx) < CondHeaderLen {
+			return fmt.Errorf("invalid conditional tx header length: %d", len(tx))
+		}
+		return nil
+	}
 	if !bytes.Equal(tx[:len(MAGIC)], MAGIC[:]) {
 		return fmt.Errorf("invalid Megablocks tx header: %v", tx[:len(MAGIC)])
 	}
@@ -224,14 +351,28 @@ func (mux *CometMux) Info(ctx context.Context, info *abcitypes.RequestInfo) (*ab
 	response := abcitypes.ResponseInfo{}
 	var err error = nil
 	for _, clt := range mux.clients {
-		resp, rc := clt.client.Info(ctx, info)
+		if clt.retired.Load() {
+			// the final app hash is kept
+			continue
+		}
+		resp, rc := clt.query().Info(ctx, info)
 		if rc != nil {
 			err = rc
+		} else if clt.lateJoining() && resp.LastBlockHeight == 0 {
+			// not activated yet
+			continue
 		} else {
 			// TODO: LastBlock Apphash for multi-apps
-			response = *resp
+			// sparse and retired chain apps may be behind the chain
+			if resp.LastBlockHeight >= response.LastBlockHeight {
+				response = *resp
+			}
+			mux.stateMtx.Lock()
+			mux.appHashes[clt.ID] = resp.LastBlockAppHash
+			mux.stateMtx.Unlock()
 		}
 	}
+	mux.committedHeight.Store(response.LastBlockHeight)
 	return &response, err
 }
 
@@ -239,13 +380,41 @@ func (mux *CometMux) Info(ctx context.Context, info *abcitypes.RequestInfo) (*ab
 func (mux *CometMux) Query(ctx context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
 	mux.log.Debug("Query called for: ", "chain-id", req.ChainId, "request", req)
 
+	// queries served by the multiplexer itself
+	if req.Path == QueryPathTxHash {
+		if mux.txIndex == nil {
+			return nil, fmt.Errorf("query failed: tx hash index not enabled")
+		}
+		return mux.txIndex.Query(req), nil
+	}
+	if req.Path == QueryPathBatch {
+		return mux.batchQuery(ctx, req), nil
+	}
+	if req.Path == QueryPathMempool {
+		return mux.queryMempool(), nil
+	}
+	if req.Path == QueryPathShadows {
+		return mux.queryShadows(), nil
+	}
+
 	hdlr, err := mux.getHandlerFromChainId(req.ChainId)
 	if err != nil {
 		mux.log.Error("call to Query failed: no handler found to forward call", "error", err)
 		return nil, fmt.Errorf("query failed: %v", err)
 	}
 	//req.Path = path[1]
-	cl := hdlr.client
+	if hdlr.retired.Load() {
+		return &abcitypes.ResponseQuery{
+			Code:      CodeQueryFailed,
+			Codespace: MegablocksCodespace,
+			Log:       fmt.Sprintf("chain app '%s' is retired since height %d and its state is exported", hdlr.ChainID, hdlr.SunsetHeight),
+		}, nil
+	}
+	if response, ok := hdlr.replicas.query(ctx, req, mux.committedHeight.Load()); ok {
+		mux.log.Debug("Query served by replica:", "chain-id", req.ChainId, "response", response)
+		return response, nil
+	}
+	cl := hdlr.query()
 	response, err := cl.Query(ctx, req)
 	if err != nil {
 		mux.log.Error("error forwarding Query", "error", err)
@@ -258,20 +427,50 @@ func (mux *CometMux) Query(ctx context.Context, req *abcitypes.RequestQuery) (*a
 // CheckTx will identify the target app based on the megablocks header and forward it to the app
 func (mux *CometMux) CheckTx(ctx context.Context, check *abcitypes.RequestCheckTx) (*abcitypes.ResponseCheckTx, error) {
 	mux.log.Info("CheckTx called: ", "type", check.Type, "length", len(check.Tx), "Tx", check.Tx)
-	hdlr, err := mux.getHandler(check.Tx[:MbHeaderLen])
+	if IsControlTx(check.Tx) {
+		return mux.checkControlTx(check.Tx), nil
+	}
+	hdlr, err := mux.getHandler(check.Tx)
 	if err != nil {
 		mux.log.Error("call to CheckTx failed:", "error", err)
 		return nil, fmt.Errorf("CheckTx failed: %s", err.Error())
 	}
 
+	if next := mux.committedHeight.Load() + 1; !hdlr.activeAt(next) {
+		reason := fmt.Sprintf("chain app '%s' is not active before height %d", hdlr.ChainID, hdlr.ActivationHeight)
+		if hdlr.sunsetAt(next) {
+			reason = fmt.Sprintf("chain app '%s' is retired since height %d", hdlr.ChainID, hdlr.SunsetHeight)
+		}
+		return &abcitypes.ResponseCheckTx{Code: CodeChainAppInactive, Codespace: MegablocksCodespace, Log: reason}, nil
+	}
+	if next := mux.committedHeight.Load() + 1; hdlr.pausedAt(next) {
+		reason := fmt.Sprintf("chain app '%s' is paused at height %d", hdlr.ChainID, next)
+		return &abcitypes.ResponseCheckTx{Code: CodeChainAppPaused, Codespace: MegablocksCodespace, Log: reason}, nil
+	}
+	if hdlr.forgesSystemTx(check.Tx) {
+		reason := fmt.Sprintf("transactions of chain app '%s' must not start with the system tx header", hdlr.ChainID)
+		return &abcitypes.ResponseCheckTx{Code: CodeReservedPayload, Codespace: MegablocksCodespace, Log: reason}, nil
+	}
+
 	// Strip MB header
-	check.Tx = check.Tx[MbHeaderLen:]
-	cl := hdlr.client
+	tx := check.Tx
+	if check.Type == abcitypes.CheckTxType_Recheck && mux.cfg.SkipUnchangedRechecks {
+		if response, cached := mux.recheckCache.Lookup(hdlr.ID, tx); cached {
+			mux.log.Debug("Recheck answered from cache", "chain-id", hdlr.ChainID)
+			mux.mempoolTracker.RecordCheckTx(hdlr.ID, tx, check.Type, response.IsOK())
+			return response, nil
+		}
+	}
+
+	check.Tx = StripHeader(check.Tx)
+	cl := hdlr.mempool()
 	response, err := cl.CheckTx(ctx, check)
 	if err != nil {
 		mux.log.Error("error forwarding CheckTx", "error", err)
 		return nil, err
 	}
+	mux.mempoolTracker.RecordCheckTx(hdlr.ID, tx, check.Type, response.IsOK())
+	mux.recheckCache.Record(tx, response)
 	return response, err
 }
 
@@ -282,19 +481,28 @@ func (mux *CometMux) InitChain(ctx context.Context, chain *abcitypes.RequestInit
 	var err error = nil
 
 	type InitResponse struct {
-		Response *abcitypes.ResponseInitChain
-		Error    error
+		Response  *abcitypes.ResponseInitChain
+		HandlerID ChainAppIdentifier
+		Error     error
+	}
+	// late joining chain apps are initialized at their activation height
+	genesisApps := []*AbciHandler{}
+	for _, client := range mux.clients {
+		if client.activeAt(chain.InitialHeight) {
+			genesisApps = append(genesisApps, client)
+		}
 	}
-	chResp := make(chan InitResponse, len(mux.clients))
+
+	chResp := make(chan InitResponse, len(genesisApps))
 	wg := sync.WaitGroup{}
-	wg.Add(len(mux.clients))
+	wg.Add(len(genesisApps))
 
-	for _, client := range mux.clients {
+	for _, client := range genesisApps {
 		client := client
 		go func() {
 			defer wg.Done()
 			resp, rc := client.InitChain(ctx, chain)
-			chResp <- InitResponse{Response: resp, Error: rc}
+			chResp <- InitResponse{Response: resp, HandlerID: client.ID, Error: rc}
 		}()
 	}
 
@@ -310,25 +518,53 @@ func (mux *CometMux) InitChain(ctx context.Context, chain *abcitypes.RequestInit
 			return nil, resp.Error
 		}
 		mux.log.Debug("Response received", "resp", resp.Response)
+		// initial app hashes are kept by sparse chain apps until their first block
+		mux.stateMtx.Lock()
+		mux.appHashes[resp.HandlerID] = resp.Response.AppHash
+		mux.stateMtx.Unlock()
 		if response == nil {
 			response = resp.Response
 		} else {
 			response.AppHash = append(response.AppHash, resp.Response.AppHash...)
+			response.Validators = append(response.Validators, resp.Response.Validators...)
 		}
 
 		// TBD: consensus parameters should be the same across chain apps
 		if resp.Response.ConsensusParams != nil {
 			response.ConsensusParams = resp.Response.ConsensusParams
 		}
-		response.Validators = append(response.Validators, resp.Response.Validators...)
 	}
 
+	// the header of the first block contains the app hashes of InitChain
+	if mux.appHashStore != nil {
+		mux.stateMtx.RLock()
+		err := mux.appHashStore.Save(chain.InitialHeight-1, mux.appHashes)
+		mux.stateMtx.RUnlock()
+		if err != nil {
+			return nil, fmt.Errorf("error storing initial app hashes: %v", err)
+		}
+	}
+
+	mux.shadowInitChain(chain)
 	return response, err
 }
 
 func (mux *CometMux) PrepareProposal(_ context.Context, proposal *abcitypes.RequestPrepareProposal) (*abcitypes.ResponsePrepareProposal, error) {
 	// TODO: to be decided if app should get the possibility to regroup this
-	response := abcitypes.ResponsePrepareProposal{Txs: proposal.Txs}
+	response := abcitypes.ResponsePrepareProposal{Txs: [][]byte{}}
+	for _, tx := range proposal.Txs {
+		// transactions of chain apps not active yet or paused and forged system transactions are left out
+		if hdlr, err := mux.getHandler(tx); err == nil &&
+			(!hdlr.activeAt(proposal.Height) || hdlr.pausedAt(proposal.Height) || hdlr.forgesSystemTx(tx)) {
+			continue
+		}
+		if IsControlTx(tx) {
+			if _, _, err := mux.verifyControlTx(tx); err != nil {
+				continue
+			}
+		}
+		response.Txs = append(response.Txs, tx)
+	}
 	mux.log.Debug("PrepareProposal called ", "#Txs", len(response.Txs), "proposal", proposal)
 	return &response, nil
 }
@@ -340,13 +576,41 @@ func (mux *CometMux) ProcessProposal(ctx context.Context, proposal *abcitypes.Re
 	handlerTxs := map[ChainAppIdentifier]([][]byte){}
 
 	for idx := range proposal.Txs {
+		if IsControlTx(proposal.Txs[idx]) {
+			if _, _, err := mux.verifyControlTx(proposal.Txs[idx]); err != nil {
+				mux.log.Info("rejecting proposal with invalid control transaction", "error", err)
+				return &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}, nil
+			}
+			continue
+		}
 		hdlr, err := mux.getHandler(proposal.Txs[idx])
 		if err != nil {
 			mux.log.Error("call to ProcessProposal failed", "error", err)
 			return nil, fmt.Errorf("no handler found for call")
 		}
+		if !hdlr.activeAt(proposal.Height) {
+			mux.log.Info("rejecting proposal with transaction of inactive chain app", "chain-id", hdlr.ChainID)
+			return &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}, nil
+		}
+		if hdlr.pausedAt(proposal.Height) {
+			mux.log.Info("rejecting proposal with transaction of paused chain app", "chain-id", hdlr.ChainID)
+			return &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}, nil
+		}
+		if hdlr.forgesSystemTx(proposal.Txs[idx]) {
+			mux.log.Info("rejecting proposal with forged system transaction", "chain-id", hdlr.ChainID)
+			return &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}, nil
+		}
+		if err := checkDependency(proposal.Txs, idx); err != nil {
+			mux.log.Info("rejecting proposal", "error", err)
+			return &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}, nil
+		}
 		// Add stripped transaction to handlers Tx set
-		handlerTxs[hdlr.ID] = append(handlerTxs[hdlr.ID], proposal.Txs[idx][MbHeaderLen:])
+		handlerTxs[hdlr.ID] = append(handlerTxs[hdlr.ID], StripHeader(proposal.Txs[idx]))
+	}
+
+	if _, cyclic := executionWaves(mapKeys(handlerTxs), proposal.Txs); cyclic {
+		mux.log.Info("rejecting proposal with cyclic dependencies of conditional transactions")
+		return &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}, nil
 	}
 
 	type ProposalResponse struct {
@@ -368,7 +632,7 @@ func (mux *CometMux) ProcessProposal(ctx context.Context, proposal *abcitypes.Re
 		mux.log.Debug("Forwarding ProcessProposal", "#TXs", len(newReq.Txs), "hdlr-id", hdlrID, "chain-id", chainID)
 		go func() {
 			defer wg.Done()
-			appResp, err := mux.clients[hdlrID].client.ProcessProposal(ctx, &newReq)
+			appResp, err := mux.clients[hdlrID].consensus().ProcessProposal(ctx, &newReq)
 			chanResp <- ProposalResponse{
 				Response:  appResp,
 				HandlerID: hdlrID,
@@ -405,6 +669,11 @@ func (mux *CometMux) ProcessProposal(ctx context.Context, proposal *abcitypes.Re
 	}
 	// TODO: to be decided if app should get the ability to check that and outcome of 'Atomic IBC'
 	mux.log.Debug("Overall Response on ProcessProposal", "response", response)
+	if response.Status == abcitypes.ResponseProcessProposal_ACCEPT && mux.cfg.OptimisticExecution {
+		if err := mux.startOptimistic(proposal); err != nil {
+			return nil, err
+		}
+	}
 	return &response, nil
 }
 
@@ -415,25 +684,60 @@ func (mux *CometMux) ProcessProposal(ctx context.Context, proposal *abcitypes.Re
 func (mux *CometMux) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
 	mux.log.Debug("FinalizeBlock called", "#Txs", len(req.Txs), "req", req)
 
-	responseSlots := map[ChainAppIdentifier][]int{}
-	handlerTxs := map[ChainAppIdentifier]([][]byte){}
-
-	for _, hdlr := range mux.clients {
-		//hdlr.HandleFinalizeBlock(req, &txResults)
-		handlerTxs[hdlr.ID] = [][]byte{}
+	// reuse the result of an optimistic execution of the decided block
+	result, err := mux.optimisticResult(ctx, req)
+	if err == nil && result == nil {
+		result, err = mux.executeBlock(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// shadows only see the decided block
+	for _, resp := range result.appResponses {
+		mux.shadowFinalizeBlock(resp.HandlerID, resp.request, resp.Response)
 	}
 
-	for idx := range req.Txs {
-		hdlr, err := mux.getHandler(req.Txs[idx])
-		if err != nil {
-			mux.log.Error("call to FinalizeBlock failed", "error", err)
-			return nil, fmt.Errorf("no handler found for call")
+	mux.stateMtx.Lock()
+	prevAppHashes := mux.appHashes
+	mux.stateMtx.Unlock()
+	if mux.wal != nil {
+		if err := mux.wal.Finalize(req, prevAppHashes, result.appResponses); err != nil {
+			mux.log.Error("error writing WAL", "height", req.Height, "error", err)
+			return nil, fmt.Errorf("error writing WAL: %v", err)
 		}
-		// Add stripped transaction to handlers Tx set
-		handlerTxs[hdlr.ID] = append(handlerTxs[hdlr.ID], req.Txs[idx][MbHeaderLen:])
-		responseSlots[hdlr.ID] = append(responseSlots[hdlr.ID], idx)
 	}
 
+	mux.finalizedHeight = req.Height
+	mux.skippedApps = result.skipped
+	mux.pendingPauses = result.pauseChanges
+	mux.stateMtx.Lock()
+	mux.recheckCache.Update(req.Txs, result.skipped)
+	mux.appHashes = result.appHashes
+	mux.stateMtx.Unlock()
+	mux.mempoolTracker.RemoveTxs(req.Txs)
+	mux.indexTxs(req)
+	mux.log.Debug("Overall FinalizeBlock response is", "response", result.response)
+	return result.response, nil
+}
+
+// blockResult is the outcome of executing a block on all chain apps
+type blockResult struct {
+	response     *abcitypes.ResponseFinalizeBlock
+	appHashes    map[ChainAppIdentifier][]byte
+	appResponses []FinalizeResponse
+	skipped      map[ChainAppIdentifier]bool // sparse chain apps not driven at the height
+	pauseChanges map[ChainAppIdentifier][]PauseChange
+}
+
+// executeBlock forwards FinalizeBlock to all apps and combines their responses
+// without changing the state of the multiplexer
+func (mux *CometMux) executeBlock(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*blockResult, error) {
+	responseSlots, err := mux.responseSlots(req.Height, req.Txs)
+	if err != nil {
+		return nil, err
+	}
+	ids := mapKeys(responseSlots)
+
 	// Send transactions to dedicated application
 	appHashes := map[ChainAppIdentifier][]byte{}
 	validatorUpdates := map[ChainAppIdentifier][]abcitypes.ValidatorUpdate{}
@@ -441,33 +745,187 @@ func (mux *CometMux) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFi
 	response := abcitypes.ResponseFinalizeBlock{
 		TxResults: make([]*abcitypes.ExecTxResult, len(req.Txs)),
 	}
+	controlResults, pauseChanges := mux.applyControlTxs(req.Height, req.Txs)
+	for idx, result := range controlResults {
+		response.TxResults[idx] = result
+	}
 
-	type FinalizeResponse struct {
-		Response  *abcitypes.ResponseFinalizeBlock
-		HandlerID ChainAppIdentifier
-		Slots     []int
-		Error     error
+	// apps with conditional transactions are executed after the apps they depend on
+	waves, cyclic := executionWaves(ids, req.Txs)
+	if cyclic {
+		mux.log.Error("cyclic dependencies of conditional transactions in block", "height", req.Height)
 	}
 
-	chanResp := make(chan FinalizeResponse, len(mux.clients))
+	appResponses := []FinalizeResponse{}
+	for _, wave := range waves {
+		results, err := mux.finalizeWave(ctx, req, wave, responseSlots, response.TxResults)
+		if err != nil {
+			return nil, err
+		}
+		appResponses = append(appResponses, results...)
+
+		for _, resp := range results {
+			hdlr := mux.clients[resp.HandlerID]
+			chainResponse := resp.Response
+			mux.placeTxResults(resp, response.TxResults)
+
+			// TBD: handling of consensus parameters from different chain apps
+			//      It is assumed that this must be equal for all chain apps
+			if response.ConsensusParamUpdates == nil {
+				response.ConsensusParamUpdates = resp.Response.ConsensusParamUpdates
+			}
+
+			// store in a map as we need ordered result on the following
+			appHashes[resp.HandlerID] = chainResponse.AppHash
+			validatorUpdates[resp.HandlerID] = chainResponse.ValidatorUpdates
+			events[resp.HandlerID] = tagEvents(chainResponse.Events, hdlr)
+		}
+	}
+
+	// sparse, paused and retired chain apps keep the app hash of their last executed height
+	skipped := map[ChainAppIdentifier]bool{}
+	mux.stateMtx.RLock()
+	for id, hdlr := range mux.clients {
+		if _, executed := responseSlots[id]; !executed && hdlr.joinedAt(req.Height) {
+			skipped[id] = true
+			appHashes[id] = mux.appHashes[id]
+		}
+	}
+	mux.stateMtx.RUnlock()
+
+	// sort hash results by ChainAppID and append them
+	keys := []ChainAppIdentifier{}
+	for k := range appHashes {
+		keys = append(keys, k)
+	}
+	SortChainAppIDs(keys)
+	for _, k := range keys {
+		response.AppHash = append(response.AppHash, appHashes[k]...)
+		response.ValidatorUpdates = append(response.ValidatorUpdates, validatorUpdates[k]...)
+		response.Events = append(response.Events, events[k]...)
+	}
+	return &blockResult{response: &response, appHashes: appHashes, appResponses: appResponses, skipped: skipped, pauseChanges: pauseChanges}, nil
+}
+
+// responseSlots returns the indexes of the transactions of each chain app active at the given height in the block
+func (mux *CometMux) responseSlots(height int64, txs [][]byte) (map[ChainAppIdentifier][]int, error) {
+	responseSlots := map[ChainAppIdentifier][]int{}
+	for _, id := range mux.activeChainApps(height) {
+		responseSlots[id] = []int{}
+	}
+
+	for idx := range txs {
+		if IsControlTx(txs[idx]) {
+			// executed by the multiplexer
+			continue
+		}
+		hdlr, err := mux.getHandler(txs[idx])
+		if err != nil {
+			mux.log.Error("call to FinalizeBlock failed", "error", err)
+			return nil, fmt.Errorf("no handler found for call")
+		}
+		if !hdlr.activeAt(height) {
+			return nil, fmt.Errorf("chain app '%s' is not active at height %d", hdlr.ChainID, height)
+		}
+		if hdlr.pausedAt(height) {
+			return nil, fmt.Errorf("chain app '%s' is paused at height %d", hdlr.ChainID, height)
+		}
+		responseSlots[hdlr.ID] = append(responseSlots[hdlr.ID], idx)
+	}
+
+	// sparse chain apps are only driven on heights with their transactions
+	for id, slots := range responseSlots {
+		if mux.clients[id].skippedAt(height, slots) {
+			delete(responseSlots, id)
+		}
+	}
+	return responseSlots, nil
+}
+
+// placeTxResults puts the tx results of a chain app into the slots of its transactions in the block
+func (mux *CometMux) placeTxResults(resp FinalizeResponse, txResults []*abcitypes.ExecTxResult) {
+	hdlr := mux.clients[resp.HandlerID]
+	for idx, result := range resp.Response.TxResults {
+		if idx < len(resp.Slots) {
+			mux.log.Debug("Adding result TxResult entry", "chain-id", hdlr.ChainID, "slots", resp.Slots, "idx", idx, "txResults", resp.Response.TxResults)
+			txResults[resp.Slots[idx]] = tagTxResult(result, hdlr)
+		} else {
+			mux.log.Debug("result index mismatch no matching slot for response")
+		}
+	}
+}
+
+// FinalizeResponse is the response of a chain app on a forwarded FinalizeBlock
+type FinalizeResponse struct {
+	Response  *abcitypes.ResponseFinalizeBlock
+	HandlerID ChainAppIdentifier
+	Slots     []int
+	Error     error
+	request   *abcitypes.RequestFinalizeBlock // request as sent to the chain app
+}
+
+// finalizeWave forwards FinalizeBlock to the given apps in parallel.
+// Conditional transactions whose dependency did not succeed are not forwarded
+// and get a 'dependency failed' result in txResults.
+func (mux *CometMux) finalizeWave(ctx context.Context, req *abcitypes.RequestFinalizeBlock, wave []ChainAppIdentifier,
+	responseSlots map[ChainAppIdentifier][]int, txResults []*abcitypes.ExecTxResult,
+) ([]FinalizeResponse, error) {
+	chanResp := make(chan FinalizeResponse, len(wave))
 	wg := sync.WaitGroup{}
-	wg.Add(len(mux.clients))
+	wg.Add(len(wave))
 
-	for hdlrID, txs := range handlerTxs {
+	for _, hdlrID := range wave {
 		hdlrID := hdlrID
-		txs := txs
+		txs := [][]byte{}
+		slots := []int{}
+		for _, slot := range responseSlots[hdlrID] {
+			if dep := DependencyIndex(req.Txs[slot]); dep >= 0 {
+				if checkDependency(req.Txs, slot) != nil || txResults[dep] == nil || txResults[dep].IsErr() {
+					mux.log.Info("Skipping conditional tx", "index", slot, "depends-on", dep)
+					txResults[slot] = tagTxResult(dependencyFailedResult(dep), mux.clients[hdlrID])
+					continue
+				}
+			}
+			// Add stripped transaction to handlers Tx set
+			txs = append(txs, StripHeader(req.Txs[slot]))
+			slots = append(slots, slot)
+		}
+		// deliver app hashes of the previous height as first transaction
+		siblingHashes := mux.clients[hdlrID].SiblingHashes
+		if siblingHashes {
+			sysTx, err := mux.siblingInfoTx(req.Height)
+			if err != nil {
+				return nil, fmt.Errorf("error creating sibling info: %v", err)
+			}
+			txs = append([][]byte{sysTx}, txs...)
+		}
 		newReq := *req
 		newReq.Txs = txs
 		chainID := mux.clients[hdlrID].ChainID
 		mux.log.Debug("Forwarding FinalizeBlock", "#TXs", len(newReq.Txs), "hdlr-id", hdlrID, "chain-id", chainID)
 		go func() {
 			defer wg.Done()
-			appResp, err := mux.clients[hdlrID].client.FinalizeBlock(ctx, &newReq)
+			hdlr := mux.clients[hdlrID]
+			var err error
+			if hdlr.lateJoining() && req.Height == hdlr.ActivationHeight {
+				// the validators of the chain app's genesis do not change the validator set
+				mux.log.Info("Activating chain app", "chain-id", chainID, "height", req.Height)
+				_, err = activateChainApp(ctx, hdlr, req)
+			}
+			var appResp *abcitypes.ResponseFinalizeBlock
+			if err == nil {
+				appResp, err = hdlr.consensus().FinalizeBlock(ctx, &newReq)
+			}
+			if err == nil && siblingHashes && len(appResp.TxResults) > 0 {
+				// drop result of the system transaction
+				appResp.TxResults = appResp.TxResults[1:]
+			}
 			chanResp <- FinalizeResponse{
 				Response:  appResp,
 				HandlerID: hdlrID,
-				Slots:     responseSlots[hdlrID],
-				Error:     err}
+				Slots:     slots,
+				Error:     err,
+				request:   &newReq}
 
 		}()
 	}
@@ -479,6 +937,7 @@ func (mux *CometMux) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFi
 	}()
 
 	// loop until all response are received
+	results := []FinalizeResponse{}
 	for resp := range chanResp {
 		chainID := mux.clients[resp.HandlerID].ChainID
 
@@ -488,67 +947,179 @@ func (mux *CometMux) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFi
 			return nil, resp.Error
 		}
 		mux.log.Debug("Response received on FinalizeBlock", "chain-id", chainID, "response", resp.Response)
+		results = append(results, resp)
+	}
 
-		slots := resp.Slots
-		chainResponse := resp.Response
-		for idx, resp := range chainResponse.TxResults {
-			if idx < len(slots) {
-				mux.log.Debug("Adding result TxResult entry", "chain-id", chainID, "slots", slots, "idx", idx, "txResults", chainResponse.TxResults)
-				response.TxResults[slots[idx]] = resp
-			} else {
-				mux.log.Debug("result index mismatch no matching slot for response")
-			}
-		}
+	// results of a wave are processed in deterministic order
+	sort.Slice(results, func(i, j int) bool {
+		return bytes.Compare(results[i].HandlerID[:], results[j].HandlerID[:]) < 0
+	})
+	return results, nil
+}
 
-		// TBD: handling of consensus parameters from different chain apps
-		//      It is assumed that this must be equal for all chain apps
-		if response.ConsensusParamUpdates == nil {
-			response.ConsensusParamUpdates = resp.Response.ConsensusParamUpdates
-		}
+// Commit sends commit to all apps in parallel. The minimum retain height of all apps is
+// returned. If only some of the apps committed, a PartialCommitError reports which did.
+func (mux *CometMux) Commit(ctx context.Context, commit *abcitypes.RequestCommit) (*abcitypes.ResponseCommit, error) {
+	mux.log.Debug("Commit called", "commit", commit)
 
-		// store in a map as we need ordered result on the following
-		appHashes[resp.HandlerID] = chainResponse.AppHash
-		validatorUpdates[resp.HandlerID] = chainResponse.ValidatorUpdates
-		events[resp.HandlerID] = chainResponse.Events
+	if mux.cfg.TwoPhaseCommit {
+		if err := mux.prepareCommit(ctx, mux.finalizedHeight); err != nil {
+			mux.log.Error("Prepare commit failed", "error", err)
+			return nil, err
+		}
 	}
 
-	// sort hash results by ChainAppID and append them
-	keys := []ChainAppIdentifier{}
-	for k := range appHashes {
-		keys = append(keys, k)
+	ids := mux.committingApps()
+	chanResp := make(chan CommitResponse, len(ids))
+	wg := sync.WaitGroup{}
+	wg.Add(len(ids))
+
+	for _, id := range ids {
+		hdlr := mux.clients[id]
+		go func() {
+			defer wg.Done()
+			resp, err := hdlr.consensus().Commit(ctx, commit)
+			if err == nil && mux.wal != nil {
+				if walErr := mux.wal.Committed(hdlr.ID); walErr != nil {
+					mux.log.Error("error writing WAL", "chain-id", hdlr.ChainID, "error", walErr)
+				}
+			}
+			chanResp <- CommitResponse{Response: resp, HandlerID: hdlr.ID, Error: err}
+		}()
 	}
-	SortChainAppIDs(keys)
-	for _, k := range keys {
-		response.AppHash = append(response.AppHash, appHashes[k]...)
-		response.ValidatorUpdates = append(response.ValidatorUpdates, validatorUpdates[k]...)
-		response.Events = append(response.Events, events[k]...)
+
+	// records of the multiplexer are written while the apps commit
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		mux.storeFinalized()
+	}()
+
+	// wait until all routines are done
+	go func() {
+		wg.Wait()
+		close(chanResp)
+	}()
+
+	results := []CommitResponse{}
+	for resp := range chanResp {
+		results = append(results, resp)
 	}
+	<-stored
 
-	mux.log.Debug("Overall FinalizeBlock response is", "response", response)
-	return &response, nil
-}
+	// results are combined in deterministic order
+	sort.Slice(results, func(i, j int) bool {
+		return bytes.Compare(results[i].HandlerID[:], results[j].HandlerID[:]) < 0
+	})
 
-// Commit sends commit to all apps
-func (mux CometMux) Commit(ctx context.Context, commit *abcitypes.RequestCommit) (*abcitypes.ResponseCommit, error) {
-	mux.log.Debug("Commit called", "commit", commit)
 	var response *abcitypes.ResponseCommit
-	for _, hdlr := range mux.clients {
-		cl := hdlr.client
-		resp, err := cl.Commit(ctx, commit)
-		if err != nil {
-			mux.log.Error("error forwarding Commit: ", err)
-			return nil, err
+	partial := &PartialCommitError{Height: mux.finalizedHeight, Failed: map[string]error{}}
+	for _, resp := range results {
+		chainID := mux.clients[resp.HandlerID].ChainID
+		if resp.Error != nil {
+			mux.log.Error("error forwarding Commit", "chain-id", chainID, "error", resp.Error)
+			partial.Failed[chainID] = resp.Error
+			continue
+		}
+		partial.Committed = append(partial.Committed, chainID)
+		if response == nil {
+			response = resp.Response
+		} else if resp.Response.RetainHeight != response.RetainHeight {
+			mux.log.Info("Retain height diverges", "chain-id", chainID,
+				"retain-height", resp.Response.RetainHeight, "min-retain-height", response.RetainHeight)
+			if resp.Response.RetainHeight < response.RetainHeight {
+				response = resp.Response
+			}
 		}
-		if response != nil && resp.RetainHeight != response.RetainHeight {
-			mux.log.Info("Unexpected retain height diverge", "chain-id", hdlr.ChainID,
-				"this height", resp.RetainHeight, "prev-height", resp.RetainHeight)
+	}
+	if len(partial.Failed) > 0 {
+		if mux.cfg.TwoPhaseCommit {
+			mux.rollbackCommit(ctx, partial)
 		}
-		response = resp
+		mux.log.Error("Partial commit", "error", partial)
+		return nil, partial
 	}
+	mux.shadowCommit(commit)
+	if err := mux.pauses.Record(mux.pendingPauses); err != nil {
+		mux.log.Error("error recording pause changes", "height", mux.finalizedHeight, "error", err)
+	}
+	mux.pendingPauses = nil
+	mux.committedHeight.Store(mux.finalizedHeight)
+	mux.exportSunsetApps(mux.finalizedHeight)
 
+	// replicas follow the committed state asynchronously
+	for _, hdlr := range mux.clients {
+		hdlr.replicas.RefreshAsync()
+	}
+	if response == nil {
+		response = &abcitypes.ResponseCommit{}
+	}
 	return response, nil
 }
 
+// indexTxs stages the hashes of the routed transactions of a block in the tx hash index
+func (mux *CometMux) indexTxs(req *abcitypes.RequestFinalizeBlock) {
+	if mux.txIndex == nil {
+		return
+	}
+	mux.txIndex.Reset()
+	for idx, tx := range req.Txs {
+		if hdlr, err := mux.getHandler(tx); err == nil {
+			mux.txIndex.Add(tx, hdlr.ChainID, req.Height, idx)
+		}
+	}
+}
+
+// storeFinalized writes the tx hash index and app hashes of the finalized height
+func (mux *CometMux) storeFinalized() {
+	if mux.txIndex != nil {
+		if err := mux.txIndex.Flush(); err != nil {
+			mux.log.Error("error writing tx hash index", "error", err)
+		}
+	}
+	if mux.appHashStore != nil {
+		mux.stateMtx.RLock()
+		err := mux.appHashStore.Save(mux.finalizedHeight, mux.appHashes)
+		mux.stateMtx.RUnlock()
+		if err != nil {
+			mux.log.Error("error storing app hashes", "height", mux.finalizedHeight, "error", err)
+		}
+	}
+}
+
+// CommitResponse is the response of a chain app on a forwarded Commit
+type CommitResponse struct {
+	Response  *abcitypes.ResponseCommit
+	HandlerID ChainAppIdentifier
+	Error     error
+}
+
+// PartialCommitError reports the chain apps which did and did not commit a height
+// and with two-phase commit the outcome of the rollback
+type PartialCommitError struct {
+	Height         int64
+	Committed      []string
+	Failed         map[string]error
+	RolledBack     []string
+	RollbackFailed map[string]error
+}
+
+func (e *PartialCommitError) Error() string {
+	failed := mapKeys(e.Failed)
+	sort.Strings(failed)
+	msgs := []string{}
+	for _, chainID := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", chainID, e.Failed[chainID]))
+	}
+	msg := fmt.Sprintf("commit of height %d failed for %v, committed by %v", e.Height, msgs, e.Committed)
+	if len(e.RolledBack) > 0 || len(e.RollbackFailed) > 0 {
+		failed := mapKeys(e.RollbackFailed)
+		sort.Strings(failed)
+		msg += fmt.Sprintf(", rolled back %v, rollback failed for %v", e.RolledBack, failed)
+	}
+	return msg
+}
+
 func (mux *CometMux) ListSnapshots(_ context.Context, snapshots *abcitypes.RequestListSnapshots) (*abcitypes.ResponseListSnapshots, error) {
 	mux.log.Debug("ListSnapshots called", "snapshot", snapshots)
 	return &abcitypes.ResponseListSnapshots{}, nil
@@ -569,7 +1140,7 @@ func (mux *CometMux) ApplySnapshotChunk(_ context.Context, chunk *abcitypes.Requ
 	return &abcitypes.ResponseApplySnapshotChunk{Result: abcitypes.ResponseApplySnapshotChunk_ACCEPT}, nil
 }
 
-func (mux CometMux) ExtendVote(_ context.Context, extend *abcitypes.RequestExtendVote) (*abcitypes.ResponseExtendVote, error) {
+func (mux *CometMux) ExtendVote(_ context.Context, extend *abcitypes.RequestExtendVote) (*abcitypes.ResponseExtendVote, error) {
 	mux.log.Debug("ExtendVote called", "request", extend)
 	return &abcitypes.ResponseExtendVote{}, nil
 }
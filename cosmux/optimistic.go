@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// optimisticExecution is the execution of an accepted proposal started before it is decided.
+// An execution which is not used is discarded on the chain apps with the rollback query of the
+// two-phase commit protocol before the height is executed again.
+type optimisticExecution struct {
+	hash   []byte
+	height int64
+	txs    [][]byte
+	cancel context.CancelFunc
+	done   chan struct{}
+	result *blockResult
+	err    error
+}
+
+// startOptimistic starts executing an accepted proposal. A running execution of an
+// earlier proposal is discarded.
+func (mux *CometMux) startOptimistic(proposal *abcitypes.RequestProcessProposal) error {
+	if err := mux.discardOptimistic(context.Background()); err != nil {
+		return err
+	}
+
+	req := &abcitypes.RequestFinalizeBlock{
+		Txs:                proposal.Txs,
+		DecidedLastCommit:  proposal.ProposedLastCommit,
+		Misbehavior:        proposal.Misbehavior,
+		Hash:               proposal.Hash,
+		Height:             proposal.Height,
+		Time:               proposal.Time,
+		NextValidatorsHash: proposal.NextValidatorsHash,
+		ProposerAddress:    proposal.ProposerAddress,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	exec := &optimisticExecution{
+		hash:   proposal.Hash,
+		height: proposal.Height,
+		txs:    proposal.Txs,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	mux.optimistic = exec
+	mux.log.Debug("Starting optimistic execution", "height", exec.height, "hash", exec.hash)
+
+	go func() {
+		defer close(exec.done)
+		exec.result, exec.err = mux.executeBlock(ctx, req)
+	}()
+	return nil
+}
+
+// discardOptimistic cancels a running optimistic execution, waits until it stopped and asks
+// the chain apps it was sent to to discard the height, so they can execute the height again
+func (mux *CometMux) discardOptimistic(ctx context.Context) error {
+	exec := mux.optimistic
+	if exec == nil {
+		return nil
+	}
+	mux.optimistic = nil
+	exec.cancel()
+	<-exec.done
+
+	responseSlots, err := mux.responseSlots(exec.height, exec.txs)
+	if err != nil {
+		// the execution was rejected before reaching any chain app
+		return nil
+	}
+	ids := mapKeys(responseSlots)
+	SortChainAppIDs(ids)
+	failed := mux.commitControl(ctx, QueryPathRollback, exec.height, ids)
+	if len(failed) > 0 {
+		chainIDs := mapKeys(failed)
+		sort.Strings(chainIDs)
+		return fmt.Errorf("discarding optimistic execution of height %d failed for %v", exec.height, chainIDs)
+	}
+	return nil
+}
+
+// optimisticResult returns the result of the optimistic execution if it executed the decided block.
+// Otherwise the execution is discarded and nil is returned.
+func (mux *CometMux) optimisticResult(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*blockResult, error) {
+	exec := mux.optimistic
+	if exec == nil {
+		return nil, nil
+	}
+	if exec.height != req.Height || !bytes.Equal(exec.hash, req.Hash) {
+		mux.log.Info("Decided block differs from optimistic execution, re-executing",
+			"height", req.Height, "hash", req.Hash, "optimistic-hash", exec.hash)
+		return nil, mux.discardOptimistic(ctx)
+	}
+
+	<-exec.done
+	if exec.err != nil {
+		mux.log.Info("Optimistic execution failed, re-executing", "height", req.Height, "error", exec.err)
+		return nil, mux.discardOptimistic(ctx)
+	}
+	mux.optimistic = nil
+	exec.cancel()
+	mux.log.Debug("Reusing optimistic execution", "height", req.Height)
+	return exec.result, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+// A chain app is paused at heights scheduled in the megablocks genesis or by control transactions
+// included in a block. A control transaction takes effect at the height after its block, so all
+// validators switch at the same height. While paused, the transactions of the chain app are rejected
+// and the chain app is not driven, its last app hash stays in the composite app hash. The paused
+// heights are not counted in the heights of the chain app, so it sees contiguous heights.
+
+// CtrlMAGIC marks control transactions pausing or resuming a chain app
+var CtrlMAGIC = [...]byte{0x23, 0x6d, 0x75, 0x70}
+
+// Actions of control transactions
+const (
+	ControlActionPause  = "pause"
+	ControlActionResume = "resume"
+)
+
+// ControlTx pauses or resumes a chain app. It must be signed by one of the control keys of the
+// megablocks genesis and carry the next sequence of the chain app's pause control.
+type ControlTx struct {
+	Action    string `json:"action"`
+	ChainID   string `json:"chain_id"`
+	Sequence  uint64 `json:"sequence"`
+	PubKey    []byte `json:"pub_key"` // ed25519
+	Signature []byte `json:"signature"`
+}
+
+// controlSignDoc is signed by the control key
+type controlSignDoc struct {
+	Network string `json:"network"` // chain ID of the megablocks chain
+	Action  string `json:"action"`
+	ChainID string `json:"chain_id"`
+	Nonce   uint64 `json:"nonce"`
+}
+
+// SignBytes returns the bytes signed by the control key. They bind the control transaction to
+// the megablocks chain and use its sequence as nonce, so it can neither be replayed on another
+// chain nor submitted again.
+func (ctrl *ControlTx) SignBytes(network string) []byte {
+	bz, _ := json.Marshal(controlSignDoc{Network: network, Action: ctrl.Action, ChainID: ctrl.ChainID, Nonce: ctrl.Sequence})
+	return bz
+}
+
+// Bytes returns the control transaction including its header
+func (ctrl *ControlTx) Bytes() ([]byte, error) {
+	bz, err := json.Marshal(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	return append(CtrlMAGIC[:], bz...), nil
+}
+
+// IsControlTx returns true if tx is a control transaction
+func IsControlTx(tx []byte) bool {
+	return len(tx) >= len(CtrlMAGIC) && string(tx[:len(CtrlMAGIC)]) == string(CtrlMAGIC[:])
+}
+
+// PauseChange pauses or resumes a chain app from the given height on
+type PauseChange struct {
+	Height   int64  `json:"height"`
+	Paused   bool   `json:"paused"`
+	Sequence uint64 `json:"sequence"` // sequence of the control transaction, 0 if scheduled
+}
+
+// PauseControl records the pause changes of all chain apps made by control transactions
+type PauseControl struct {
+	mtx     sync.RWMutex
+	db      dbm.DB
+	changes map[ChainAppIdentifier][]PauseChange
+}
+
+// NewPauseControl creates a pause control without any changes
+func NewPauseControl() *PauseControl {
+	return &PauseControl{changes: map[ChainAppIdentifier][]PauseChange{}}
+}
+
+func pauseChangeKey(id ChainAppIdentifier, sequence uint64) []byte {
+	key := append([]byte("pause:"), id[:]...)
+	return binary.BigEndian.AppendUint64(key, sequence)
+}
+
+// Load attaches the pause control to the database and reads the recorded changes
+func (p *PauseControl) Load(db dbm.DB) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	it, err := dbm.IteratePrefix(db, []byte("pause:"))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	changes := map[ChainAppIdentifier][]PauseChange{}
+	for ; it.Valid(); it.Next() {
+		var id ChainAppIdentifier
+		copy(id[:], it.Key()[len("pause:"):])
+		change := PauseChange{}
+		if err := json.Unmarshal(it.Value(), &change); err != nil {
+			return fmt.Errorf("invalid pause change: %v", err)
+		}
+		changes[id] = append(changes[id], change)
+	}
+	p.db = db
+	p.changes = changes
+	return nil
+}
+
+// pausedAt returns true if the chain app is paused by a control transaction at the given height
+func (p *PauseControl) pausedAt(id ChainAppIdentifier, height int64) bool {
+	if p == nil {
+		return false
+	}
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	changes := p.changes[id]
+	idx := sort.Search(len(changes), func(i int) bool { return changes[i].Height > height })
+	return idx > 0 && changes[idx-1].Paused
+}
+
+// changeHeights returns the heights the pause of the chain app changed at
+func (p *PauseControl) changeHeights(id ChainAppIdentifier) []int64 {
+	if p == nil {
+		return nil
+	}
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	heights := []int64{}
+	for _, change := range p.changes[id] {
+		heights = append(heights, change.Height)
+	}
+	return heights
+}
+
+// sequence returns the sequence of the last control transaction of the chain app
+func (p *PauseControl) sequence(id ChainAppIdentifier) uint64 {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	changes := p.changes[id]
+	if len(changes) == 0 {
+		return 0
+	}
+	return changes[len(changes)-1].Sequence
+}
+
+// Record adds the changes of a block. Changes recorded already are ignored.
+func (p *PauseControl) Record(changes map[ChainAppIdentifier][]PauseChange) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, id := range mapKeys(changes) {
+		for _, change := range changes[id] {
+			recorded := p.changes[id]
+			if len(recorded) > 0 && recorded[len(recorded)-1].Sequence >= change.Sequence {
+				continue
+			}
+			p.changes[id] = append(recorded, change)
+			if p.db == nil {
+				continue
+			}
+			value, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			if err := p.db.SetSync(pauseChangeKey(id, change.Sequence), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetPauseStore records the pause changes made by control transactions in the given database
+func (mux *CometMux) SetPauseStore(db dbm.DB) error {
+	return mux.pauses.Load(db)
+}
+
+// scheduledPauseAt returns true if the chain app is paused at the given height by the genesis
+func (hdl *AbciHandler) scheduledPauseAt(height int64) bool {
+	return hdl.PauseHeight > 0 && height >= hdl.PauseHeight && (hdl.ResumeHeight == 0 || height < hdl.ResumeHeight)
+}
+
+// pausedAt returns true if the chain app is paused at the given height
+func (hdl *AbciHandler) pausedAt(height int64) bool {
+	return hdl.scheduledPauseAt(height) || hdl.pauses.pausedAt(hdl.ID, height)
+}
+
+// pauseBoundaries returns the sorted heights the pause of the chain app may change at
+func (hdl *AbciHandler) pauseBoundaries() []int64 {
+	heights := hdl.pauses.changeHeights(hdl.ID)
+	if hdl.PauseHeight > 0 {
+		heights = append(heights, hdl.PauseHeight)
+		if hdl.ResumeHeight > 0 {
+			heights = append(heights, hdl.ResumeHeight)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// pausedBefore returns the number of heights below the given height the chain app was paused at
+func (hdl *AbciHandler) pausedBefore(height int64) int64 {
+	bounds := hdl.pauseBoundaries()
+	paused := int64(0)
+	for idx, from := range bounds {
+		if from >= height {
+			break
+		}
+		to := height
+		if idx+1 < len(bounds) && bounds[idx+1] < height {
+			to = bounds[idx+1]
+		}
+		if hdl.pausedAt(from) {
+			paused += to - from
+		}
+	}
+	return paused
+}
+
+// unpausedHeight returns the height the chain app executed the given number of heights at,
+// i.e. the inverse of not counting the paused heights
+func (hdl *AbciHandler) unpausedHeight(executed int64) int64 {
+	bounds := hdl.pauseBoundaries()
+	height := executed
+	for idx, from := range bounds {
+		if from > height {
+			break
+		}
+		if idx+1 < len(bounds) && hdl.pausedAt(from) {
+			height += bounds[idx+1] - from
+		}
+	}
+	return height
+}
+
+// verifyControlTx decodes a control transaction and checks its signature and chain app
+func (mux *CometMux) verifyControlTx(tx []byte) (*ControlTx, *AbciHandler, error) {
+	ctrl := &ControlTx{}
+	if err := json.Unmarshal(tx[len(CtrlMAGIC):], ctrl); err != nil {
+		return nil, nil, fmt.Errorf("invalid control tx: %v", err)
+	}
+	if ctrl.Action != ControlActionPause && ctrl.Action != ControlActionResume {
+		return nil, nil, fmt.Errorf("invalid control action '%s'", ctrl.Action)
+	}
+	authorized := false
+	for _, key := range mux.controlKeys {
+		if key == hex.EncodeToString(ctrl.PubKey) {
+			authorized = true
+		}
+	}
+	if !authorized || len(ctrl.PubKey) != ed25519.PubKeySize {
+		return nil, nil, fmt.Errorf("control tx not signed by a control key")
+	}
+	if !ed25519.PubKey(ctrl.PubKey).VerifySignature(ctrl.SignBytes(mux.network), ctrl.Signature) {
+		return nil, nil, fmt.Errorf("invalid signature of control tx")
+	}
+	hdlr, err := mux.getHandlerFromChainId(ctrl.ChainID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctrl, hdlr, nil
+}
+
+// checkControlTx answers CheckTx of a control transaction
+func (mux *CometMux) checkControlTx(tx []byte) *abcitypes.ResponseCheckTx {
+	ctrl, hdlr, err := mux.verifyControlTx(tx)
+	if err == nil && ctrl.Sequence <= mux.pauses.sequence(hdlr.ID) {
+		err = fmt.Errorf("control sequence %d of '%s' used already", ctrl.Sequence, hdlr.ChainID)
+	}
+	if err != nil {
+		return &abcitypes.ResponseCheckTx{Code: CodeInvalidControlTx, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	return &abcitypes.ResponseCheckTx{}
+}
+
+// applyControlTxs executes the control transactions of a block. It returns their results by
+// index in the block and the pause changes taking effect at the next height.
+func (mux *CometMux) applyControlTxs(height int64, txs [][]byte) (map[int]*abcitypes.ExecTxResult, map[ChainAppIdentifier][]PauseChange) {
+	results := map[int]*abcitypes.ExecTxResult{}
+	changes := map[ChainAppIdentifier][]PauseChange{}
+	sequences := map[ChainAppIdentifier]uint64{}
+	for idx, tx := range txs {
+		if !IsControlTx(tx) {
+			continue
+		}
+		ctrl, hdlr, err := mux.verifyControlTx(tx)
+		if err == nil {
+			if _, exists := sequences[hdlr.ID]; !exists {
+				sequences[hdlr.ID] = mux.pauses.sequence(hdlr.ID)
+			}
+			if ctrl.Sequence != sequences[hdlr.ID]+1 {
+				err = fmt.Errorf("expected control sequence %d of '%s', got %d", sequences[hdlr.ID]+1, hdlr.ChainID, ctrl.Sequence)
+			}
+		}
+		if err != nil {
+			results[idx] = &abcitypes.ExecTxResult{Code: CodeInvalidControlTx, Codespace: MegablocksCodespace, Log: err.Error()}
+			continue
+		}
+		sequences[hdlr.ID] = ctrl.Sequence
+		changes[hdlr.ID] = append(changes[hdlr.ID], PauseChange{
+			Height:   height + 1,
+			Paused:   ctrl.Action == ControlActionPause,
+			Sequence: ctrl.Sequence,
+		})
+		results[idx] = &abcitypes.ExecTxResult{
+			Codespace: MegablocksCodespace,
+			Log:       fmt.Sprintf("%s '%s' from height %d", ctrl.Action, hdlr.ChainID, height+1),
+		}
+	}
+	return results, changes
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	sm "github.com/cometbft/cometbft/state"
+	comettypes "github.com/cometbft/cometbft/types"
+)
+
+// RebuildChainApp rebuilds the state of a single chain app from the CometBFT block store.
+// Starting at genesis (from == 0) the chain app is initialized first, otherwise it must be at
+// height from-1. The resulting app hash of each height is checked against the composite app
+// hash recorded in the following block.
+func (mux *CometMux) RebuildChainApp(ctx context.Context, chainID string, from int64,
+	blockStore sm.BlockStore, stateStore sm.Store, genesis *comettypes.GenesisDoc,
+) error {
+	hdlr, err := mux.getHandlerFromChainId(chainID)
+	if err != nil {
+		return err
+	}
+	state, err := stateStore.Load()
+	if err != nil {
+		return fmt.Errorf("error loading state: %v", err)
+	}
+
+	switch {
+	case from == 0 && hdlr.lateJoining():
+		// initialized when the activation height is replayed
+		if err := hdlr.activation.Reset(); err != nil {
+			return fmt.Errorf("error resetting activation of '%s': %v", hdlr.ChainID, err)
+		}
+		from = hdlr.ActivationHeight
+	case from == 0:
+		if err := mux.initChainApp(ctx, hdlr, genesis); err != nil {
+			return err
+		}
+		from = genesis.InitialHeight
+	default:
+		info, err := hdlr.query().Info(ctx, &abcitypes.RequestInfo{})
+		if err != nil {
+			return fmt.Errorf("error getting info of '%s': %v", hdlr.ChainID, err)
+		}
+		if height := hdlr.lastHeight(info); height != from-1 {
+			return fmt.Errorf("chain app '%s' is at height %d, cannot replay from height %d", hdlr.ChainID, height, from)
+		}
+	}
+	if !hdlr.activeAt(from) {
+		return fmt.Errorf("chain app '%s' is not active at height %d", hdlr.ChainID, from)
+	}
+	if from < blockStore.Base() {
+		return fmt.Errorf("height %d is below the block store base %d", from, blockStore.Base())
+	}
+
+	to := blockStore.Height()
+	if last := hdlr.lastActiveHeight(); last > 0 && last < to {
+		// a retired chain app ends at its last height
+		to = last
+	}
+	mux.log.Info("Rebuilding chain app", "chain-id", hdlr.ChainID, "from", from, "to", to)
+	for height := from; height <= to; height++ {
+		if hdlr.pausedAt(height) {
+			// a paused chain app keeps its state
+			continue
+		}
+		block := blockStore.LoadBlock(height)
+		if block == nil {
+			return fmt.Errorf("block at height %d not found", height)
+		}
+		responseSlots, err := mux.responseSlots(height, block.Txs.ToSliceOfBytes())
+		if err != nil {
+			return err
+		}
+		if _, driven := responseSlots[hdlr.ID]; !driven {
+			// a sparse chain app is not driven without its transactions
+			continue
+		}
+		results, err := mux.replayBlock(ctx, blockStore, stateStore, state.InitialHeight, height,
+			map[ChainAppIdentifier]bool{hdlr.ID: true})
+		if err != nil {
+			return err
+		}
+		if len(results) != 1 {
+			return fmt.Errorf("no response of '%s' at height %d", hdlr.ChainID, height)
+		}
+		if _, err := hdlr.consensus().Commit(ctx, &abcitypes.RequestCommit{}); err != nil {
+			return fmt.Errorf("error committing '%s' at height %d: %v", hdlr.ChainID, height, err)
+		}
+
+		// the composite app hash of a height is recorded in the header of the next block
+		recorded := state.AppHash
+		if height < to {
+			meta := blockStore.LoadBlockMeta(height + 1)
+			if meta == nil {
+				return fmt.Errorf("block at height %d not found", height+1)
+			}
+			recorded = meta.Header.AppHash
+		}
+		if err := mux.checkCompositeAppHash(hdlr, height, results[0].Response.AppHash, recorded); err != nil {
+			return err
+		}
+		mux.log.Info("Rebuilt height", "chain-id", hdlr.ChainID, "height", height)
+	}
+	return nil
+}
+
+// initChainApp sends InitChain of the genesis to a single chain app
+func (mux *CometMux) initChainApp(ctx context.Context, hdlr *AbciHandler, genesis *comettypes.GenesisDoc) error {
+	validators := make([]*comettypes.Validator, len(genesis.Validators))
+	for idx, val := range genesis.Validators {
+		validators[idx] = comettypes.NewValidator(val.PubKey, val.Power)
+	}
+	params := genesis.ConsensusParams.ToProto()
+	_, err := hdlr.InitChain(ctx, &abcitypes.RequestInitChain{
+		Time:            genesis.GenesisTime,
+		ChainId:         genesis.ChainID,
+		InitialHeight:   genesis.InitialHeight,
+		ConsensusParams: &params,
+		Validators:      comettypes.TM2PB.ValidatorUpdates(comettypes.NewValidatorSet(validators)),
+	})
+	if err != nil {
+		return fmt.Errorf("error initializing '%s': %v", hdlr.ChainID, err)
+	}
+	return nil
+}
+
+// checkCompositeAppHash verifies that the app hash of a chain app matches the recorded composite
+// app hash at the given height. The app hashes of the other chain apps are taken from the app
+// hash store.
+func (mux *CometMux) checkCompositeAppHash(hdlr *AbciHandler, height int64, appHash []byte, recorded []byte) error {
+	appHashes := map[ChainAppIdentifier][]byte{hdlr.ID: appHash}
+	for id, other := range mux.clients {
+		if id == hdlr.ID || !other.joinedAt(height) {
+			continue
+		}
+		if mux.appHashStore == nil {
+			return fmt.Errorf("app hash store required to check app hash of '%s'", hdlr.ChainID)
+		}
+		hash, err := mux.appHashStore.Load(height, id)
+		if err != nil {
+			return fmt.Errorf("cannot check app hash of '%s' at height %d: app hash of '%s': %v", hdlr.ChainID, height, other.ChainID, err)
+		}
+		appHashes[id] = hash
+	}
+	if composite := compositeAppHash(appHashes); !bytes.Equal(composite, recorded) {
+		return fmt.Errorf("app hash of '%s' at height %d is %X, composite app hash %X does not match recorded %X",
+			hdlr.ChainID, height, appHash, composite, recorded)
+	}
+	return nil
+}
+
+// compositeAppHash concatenates the app hashes of all chain apps ordered by their identifier
+func compositeAppHash(appHashes map[ChainAppIdentifier][]byte) []byte {
+	ids := mapKeys(appHashes)
+	SortChainAppIDs(ids)
+	composite := []byte{}
+	for _, id := range ids {
+		composite = append(composite, appHashes[id]...)
+	}
+	return composite
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	comettypes "github.com/cometbft/cometbft/types"
+)
+
+// RecheckCache keeps the last CheckTx result of the pending transactions, so rechecks of
+// chain apps which were not driven by the last block can be answered without a round-trip.
+// A chain app receiving FinalizeBlock and Commit resets its check state even if its app hash
+// did not change, so its earlier results are stale.
+type RecheckCache struct {
+	mtx       sync.Mutex
+	results   map[string]*abcitypes.ResponseCheckTx
+	unchanged map[ChainAppIdentifier]bool
+}
+
+// NewRecheckCache creates an empty cache
+func NewRecheckCache() *RecheckCache {
+	return &RecheckCache{
+		results:   map[string]*abcitypes.ResponseCheckTx{},
+		unchanged: map[ChainAppIdentifier]bool{},
+	}
+}
+
+// Record stores the result of a transaction including the Megablocks header, rejected
+// transactions are dropped as they leave the mempool
+func (c *RecheckCache) Record(tx []byte, response *abcitypes.ResponseCheckTx) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := string(comettypes.Tx(tx).Hash())
+	if response.IsOK() {
+		c.results[key] = response
+	} else {
+		delete(c.results, key)
+	}
+}
+
+// Lookup returns the earlier result of a recheck if the chain app was not driven by the last block
+func (c *RecheckCache) Lookup(id ChainAppIdentifier, tx []byte) (*abcitypes.ResponseCheckTx, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.unchanged[id] {
+		return nil, false
+	}
+	response, exists := c.results[string(comettypes.Tx(tx).Hash())]
+	return response, exists
+}
+
+// Update drops the transactions of a finalized block and records the chain apps which
+// did not receive FinalizeBlock and Commit for it
+func (c *RecheckCache) Update(txs [][]byte, skipped map[ChainAppIdentifier]bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, tx := range txs {
+		delete(c.results, string(comettypes.Tx(tx).Hash()))
+	}
+	c.unchanged = map[ChainAppIdentifier]bool{}
+	for id, skip := range skipped {
+		c.unchanged[id] = skip
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	abcicli "github.com/cometbft/cometbft/abci/client"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+)
+
+// replicaRefreshTimeout bounds a refresh of the replicas of a chain app
+const replicaRefreshTimeout = 5 * time.Second
+
+// Replica is a read-only instance of a chain app serving queries
+type Replica struct {
+	Address string
+	client  abcicli.Client
+	height  atomic.Int64
+	healthy atomic.Bool
+}
+
+// ReplicaSet balances queries of a chain app across its read replicas
+type ReplicaSet struct {
+	replicas   []*Replica
+	next       atomic.Uint64
+	refreshing atomic.Bool // set while a background refresh runs
+	stopped    atomic.Bool // set once the replicas are disconnected
+	log        cmtlog.Logger
+}
+
+// NewReplicaSet creates a set of replicas, all considered unhealthy until refreshed
+func NewReplicaSet(logger cmtlog.Logger, replicas ...*Replica) *ReplicaSet {
+	return &ReplicaSet{replicas: replicas, log: logger}
+}
+
+// Start connects to all replicas. Replicas which are not reachable remain unhealthy.
+func (rs *ReplicaSet) Start() {
+	if rs == nil {
+		return
+	}
+	for _, replica := range rs.replicas {
+		if replica.client.IsRunning() {
+			continue
+		}
+		if err := replica.client.Start(); err != nil {
+			rs.log.Error("error connecting to replica", "address", replica.Address, "error", err)
+		}
+	}
+}
+
+// Stop disconnects all replicas, they serve no more queries
+func (rs *ReplicaSet) Stop() {
+	if rs == nil || rs.stopped.Swap(true) {
+		return
+	}
+	for _, replica := range rs.replicas {
+		replica.healthy.Store(false)
+		if !replica.client.IsRunning() {
+			continue
+		}
+		if err := replica.client.Stop(); err != nil {
+			rs.log.Error("error disconnecting replica", "address", replica.Address, "error", err)
+		}
+	}
+}
+
+// Refresh updates the health and latest height of all replicas
+func (rs *ReplicaSet) Refresh(ctx context.Context) {
+	if rs == nil || rs.stopped.Load() {
+		return
+	}
+	for _, replica := range rs.replicas {
+		info, err := replica.client.Info(ctx, &abcitypes.RequestInfo{})
+		if err != nil {
+			rs.log.Error("replica not available", "address", replica.Address, "error", err)
+			replica.healthy.Store(false)
+			continue
+		}
+		replica.height.Store(info.LastBlockHeight)
+		replica.healthy.Store(true)
+	}
+}
+
+// RefreshAsync refreshes the replicas in the background with a deadline.
+// It is skipped while the previous refresh is still running.
+func (rs *ReplicaSet) RefreshAsync() {
+	if rs == nil || rs.stopped.Load() || !rs.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer rs.refreshing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), replicaRefreshTimeout)
+		defer cancel()
+		rs.Refresh(ctx)
+	}()
+}
+
+// Select returns the next healthy replica which reached the given height, nil if there is none
+func (rs *ReplicaSet) Select(height int64) *Replica {
+	if rs == nil || len(rs.replicas) == 0 || rs.stopped.Load() {
+		return nil
+	}
+	start := rs.next.Add(1)
+	for i := 0; i < len(rs.replicas); i++ {
+		replica := rs.replicas[(start+uint64(i))%uint64(len(rs.replicas))]
+		if replica.healthy.Load() && replica.height.Load() >= height {
+			return replica
+		}
+	}
+	return nil
+}
+
+// query forwards a query to a replica if one is available at the requested height.
+// Returns false if the query needs to be served by the primary.
+func (rs *ReplicaSet) query(ctx context.Context, req *abcitypes.RequestQuery, latest int64) (*abcitypes.ResponseQuery, bool) {
+	height := req.Height
+	if height == 0 {
+		height = latest
+	}
+	replica := rs.Select(height)
+	if replica == nil {
+		return nil, false
+	}
+	response, err := replica.client.Query(ctx, req)
+	if err != nil {
+		rs.log.Error("query on replica failed", "address", replica.Address, "error", err)
+		replica.healthy.Store(false)
+		return nil, false
+	}
+	return response, true
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	cmtjson "github.com/cometbft/cometbft/libs/json"
+)
+
+// RPC methods rewritten by the proxy
+var (
+	txMethods = map[string]bool{
+		"broadcast_tx_sync":   true,
+		"broadcast_tx_async":  true,
+		"broadcast_tx_commit": true,
+		"check_tx":            true,
+	}
+	queryMethod = "abci_query"
+	// names of the positional params of abci_query
+	queryParamNames = []string{"path", "data", "height", "prove"}
+	// methods served from the per-chain views
+	viewMethods = map[string]bool{
+		"block":         true,
+		"block_results": true,
+	}
+)
+
+// rpcRequest is a JSON-RPC 2.0 request as served by CometBFT
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+// RPCProxy serves the CometBFT RPC under a per-chain base path '/<chain-id>/'.
+// Transactions get the Megablocks header of the chain app prepended and queries
+// are routed to the chain app. Results are returned unchanged, so unmodified
+// clients of a chain app can use the per-chain URL as node address.
+type RPCProxy struct {
+	mux     *CometMux
+	proxy   *httputil.ReverseProxy
+	server  *http.Server
+	views   *ChainViews
+	events  *ChainEvents
+	mempool MempoolReader
+}
+
+// NewRPCProxy creates a proxy forwarding to the CometBFT RPC at 'target'
+// e.g. "tcp://127.0.0.1:26657"
+func NewRPCProxy(mux *CometMux, target string) (*RPCProxy, error) {
+	targetURL, err := url.Parse(strings.Replace(target, "tcp://", "http://", 1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RPC address '%s': %v", target, err)
+	}
+	return &RPCProxy{
+		mux:   mux,
+		proxy: httputil.NewSingleHostReverseProxy(targetURL),
+	}, nil
+}
+
+// SetChainViews serves 'block' and 'block_results' from the per-chain views
+func (p *RPCProxy) SetChainViews(views *ChainViews) {
+	p.views = views
+}
+
+// SetChainEvents serves per-chain subscriptions on '/<chain-id>/websocket'
+func (p *RPCProxy) SetChainEvents(events *ChainEvents) {
+	p.events = events
+}
+
+// SetMempool serves the mempool breakdown by chain app on MempoolStatsPath
+func (p *RPCProxy) SetMempool(mempool MempoolReader) {
+	p.mempool = mempool
+}
+
+// splitChainPath splits '/<chain-id>/<path>' into chain ID and remaining path
+func splitChainPath(path string) (chainID, rest string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	rest = "/"
+	if len(parts) == 2 {
+		rest += parts[1]
+	}
+	return parts[0], rest
+}
+
+// ServeHTTP rewrites requests of a chain app and forwards them to CometBFT
+func (p *RPCProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == MempoolStatsPath && p.mempool != nil {
+		p.serveMempoolStats(w)
+		return
+	}
+
+	chainID, rest := splitChainPath(r.URL.Path)
+	hdlr, err := p.mux.getHandlerFromChainId(chainID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if rest == "/websocket" && p.events != nil {
+		p.events.ServeWebsocket(w, r, hdlr)
+		return
+	}
+
+	var request *rpcRequest
+	switch r.Method {
+	case http.MethodPost:
+		request, err = p.rewriteBody(r, hdlr)
+	case http.MethodGet:
+		request, err = p.rewriteURI(r, hdlr, rest)
+	}
+	if err == nil && request != nil && p.views != nil && viewMethods[request.Method] {
+		p.serveView(w, request, hdlr)
+		return
+	}
+	if err != nil {
+		p.mux.log.Error("error rewriting RPC request", "chain-id", chainID, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.URL.Path = rest
+	r.URL.RawPath = ""
+	p.proxy.ServeHTTP(w, r)
+}
+
+// rewriteBody rewrites single and batched JSON-RPC requests.
+// Single requests are returned to be checked for locally served methods.
+func (p *RPCProxy) rewriteBody(r *http.Request, hdlr *AbciHandler) (*rpcRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+
+	var single *rpcRequest
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		requests := []rpcRequest{}
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return nil, fmt.Errorf("invalid JSON-RPC batch: %v", err)
+		}
+		for idx := range requests {
+			if err := rewriteParams(&requests[idx], hdlr); err != nil {
+				return nil, err
+			}
+		}
+		body, err = json.Marshal(requests)
+	} else {
+		request := rpcRequest{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, fmt.Errorf("invalid JSON-RPC request: %v", err)
+		}
+		if err := rewriteParams(&request, hdlr); err != nil {
+			return nil, err
+		}
+		single = &request
+		body, err = json.Marshal(request)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return single, nil
+}
+
+// rewriteParams adds the Megablocks header to transactions and the chain ID to queries
+func rewriteParams(req *rpcRequest, hdlr *AbciHandler) error {
+	switch {
+	case txMethods[req.Method]:
+		var tx []byte
+		// params are either positional or named
+		positional := []json.RawMessage{}
+		if err := json.Unmarshal(req.Params, &positional); err == nil && len(positional) > 0 {
+			if err := json.Unmarshal(positional[0], &tx); err != nil {
+				return fmt.Errorf("invalid tx param: %v", err)
+			}
+			positional[0], _ = json.Marshal(append(CreateHeader(hdlr.ID), tx...))
+			params, err := json.Marshal(positional)
+			req.Params = params
+			return err
+		}
+		named := map[string]json.RawMessage{}
+		if err := json.Unmarshal(req.Params, &named); err != nil {
+			return fmt.Errorf("invalid params of %s: %v", req.Method, err)
+		}
+		if err := json.Unmarshal(named["tx"], &tx); err != nil {
+			return fmt.Errorf("invalid tx param: %v", err)
+		}
+		named["tx"], _ = json.Marshal(append(CreateHeader(hdlr.ID), tx...))
+		params, err := json.Marshal(named)
+		req.Params = params
+		return err
+
+	case req.Method == queryMethod:
+		named := map[string]json.RawMessage{}
+		// positional params are forwarded as named params to add the chain ID
+		positional := []json.RawMessage{}
+		if err := json.Unmarshal(req.Params, &positional); err == nil {
+			if len(positional) > len(queryParamNames) {
+				return fmt.Errorf("too many params of %s: %d", req.Method, len(positional))
+			}
+			for idx, param := range positional {
+				named[queryParamNames[idx]] = param
+			}
+		} else if err := json.Unmarshal(req.Params, &named); err != nil {
+			return fmt.Errorf("invalid params of %s: %v", req.Method, err)
+		}
+		named["chain_id"], _ = json.Marshal(hdlr.ChainID)
+		params, err := json.Marshal(named)
+		req.Params = params
+		return err
+	}
+	return nil
+}
+
+// rewriteURI rewrites URI-style requests e.g. '/broadcast_tx_sync?tx=0x...'
+// Requests of locally served methods are returned as JSON-RPC request.
+func (p *RPCProxy) rewriteURI(r *http.Request, hdlr *AbciHandler, path string) (*rpcRequest, error) {
+	method := strings.TrimPrefix(path, "/")
+	query := r.URL.Query()
+
+	switch {
+	case txMethods[method]:
+		tx, err := decodeURIBytes(query.Get("tx"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tx param: %v", err)
+		}
+		query.Set("tx", "0x"+hex.EncodeToString(append(CreateHeader(hdlr.ID), tx...)))
+	case method == queryMethod:
+		query.Set("chain_id", strconv.Quote(hdlr.ChainID))
+	case viewMethods[method]:
+		params := map[string]string{}
+		if height := query.Get("height"); height != "" {
+			params["height"] = strings.Trim(height, "\"")
+		}
+		encoded, err := json.Marshal(params)
+		return &rpcRequest{JSONRPC: "2.0", ID: json.RawMessage("-1"), Method: method, Params: encoded}, err
+	default:
+		return nil, nil
+	}
+	r.URL.RawQuery = query.Encode()
+	return nil, nil
+}
+
+// serveView answers requests on the per-chain views
+func (p *RPCProxy) serveView(w http.ResponseWriter, req *rpcRequest, hdlr *AbciHandler) {
+	response := rpcResponse{JSONRPC: "2.0", ID: req.ID}
+
+	var result interface{}
+	height, err := heightParam(req.Params)
+	if err == nil {
+		switch req.Method {
+		case "block":
+			result, err = p.views.Block(hdlr, height)
+		case "block_results":
+			result, err = p.views.BlockResults(hdlr, height)
+		}
+	}
+	if err == nil {
+		response.Result, err = cmtjson.Marshal(result)
+	}
+	if err != nil {
+		response.Error = &rpcError{Code: -32603, Message: "Internal error", Data: err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		p.mux.log.Error("error writing RPC response", "error", err)
+	}
+}
+
+// serveMempoolStats answers with the pending transactions and CheckTx statistics per chain app
+func (p *RPCProxy) serveMempoolStats(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.mux.MempoolStats(p.mempool)); err != nil {
+		p.mux.log.Error("error writing mempool stats", "error", err)
+	}
+}
+
+// heightParam decodes the optional height given as named or positional parameter
+func heightParam(params json.RawMessage) (*int64, error) {
+	var raw json.RawMessage
+	named := map[string]json.RawMessage{}
+	positional := []json.RawMessage{}
+	if err := json.Unmarshal(params, &named); err == nil {
+		raw = named["height"]
+	} else if err := json.Unmarshal(params, &positional); err == nil && len(positional) > 0 {
+		raw = positional[0]
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	height, err := strconv.ParseInt(strings.Trim(string(raw), "\""), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid height: %v", err)
+	}
+	return &height, nil
+}
+
+// decodeURIBytes decodes a byte parameter of an URI request given either
+// as hex string '0x...', quoted string or base64
+func decodeURIBytes(param string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(param, "0x"):
+		return hex.DecodeString(param[2:])
+	case strings.HasPrefix(param, "\""):
+		unquoted, err := strconv.Unquote(param)
+		return []byte(unquoted), err
+	default:
+		return base64.StdEncoding.DecodeString(param)
+	}
+}
+
+// Start serves the proxy on the given address
+func (p *RPCProxy) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error starting RPC proxy: %v", err)
+	}
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			p.mux.log.Error("RPC proxy stopped", "error", err)
+		}
+	}()
+	p.mux.log.Info("RPC proxy started", "address", address)
+	return nil
+}
+
+// Stop shuts the proxy down
+func (p *RPCProxy) Stop() error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Close()
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtbytes "github.com/cometbft/cometbft/libs/bytes"
+	cmtjson "github.com/cometbft/cometbft/libs/json"
+	cmtlog "github.com/cometbft/cometbft/libs/log"
+	ctypes "github.com/cometbft/cometbft/rpc/core/types"
+	rpcserver "github.com/cometbft/cometbft/rpc/jsonrpc/server"
+	rpctypes "github.com/cometbft/cometbft/rpc/jsonrpc/types"
+	sm "github.com/cometbft/cometbft/state"
+	comettypes "github.com/cometbft/cometbft/types"
+	"github.com/gorilla/websocket"
+)
+
+// startRPCProxy starts a proxy for chain 'chainA' in front of a fake CometBFT RPC
+// which records the last request received
+func startRPCProxy(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		getChainAppIdentifier("chainA"): {ChainID: "chainA", ID: getChainAppIdentifier("chainA")},
+	}
+
+	cometRPC := httptest.NewServer(handler)
+	t.Cleanup(cometRPC.Close)
+	proxy, err := NewRPCProxy(cosmux, strings.Replace(cometRPC.URL, "http://", "tcp://", 1))
+	if err != nil {
+		t.Fatalf("error creating proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRPCProxy(t *testing.T) {
+	var path, rawQuery string
+	var received rpcRequest
+	server := startRPCProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		path, rawQuery = r.URL.Path, r.URL.RawQuery
+		received = rpcRequest{}
+		if r.Method == http.MethodPost {
+			body, _ := io.ReadAll(r.Body)
+			_ = json.Unmarshal(body, &received)
+		}
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+	})
+
+	// broadcast_tx_sync gets the Megablocks header
+	body := `{"jsonrpc":"2.0","id":1,"method":"broadcast_tx_sync","params":{"tx":"AQI="}}`
+	resp, err := http.Post(server.URL+"/chainA", "application/json", strings.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("proxy request failed: resp=%v, err=%v", resp, err)
+	}
+	params := map[string][]byte{}
+	if err := json.Unmarshal(received.Params, &params); err != nil {
+		t.Fatalf("error decoding forwarded params: %v", err)
+	}
+	if want := append(createHeader("chainA"), 0x01, 0x02); !bytes.Equal(params["tx"], want) || path != "/" {
+		t.Errorf("unexpected forwarded tx: path=%s, got=%v, want=%v", path, params["tx"], want)
+	}
+
+	// abci_query gets the chain ID
+	body = `{"jsonrpc":"2.0","id":2,"method":"abci_query","params":{"path":"/store","data":"01"}}`
+	if _, err := http.Post(server.URL+"/chainA/", "application/json", strings.NewReader(body)); err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	query := map[string]string{}
+	if err := json.Unmarshal(received.Params, &query); err != nil || query["chain_id"] != "chainA" {
+		t.Errorf("chain ID not set on query: %v (%v)", query, err)
+	}
+
+	// positional params of abci_query are forwarded as named params
+	body = `{"jsonrpc":"2.0","id":3,"method":"abci_query","params":["/store","01"]}`
+	if _, err := http.Post(server.URL+"/chainA/", "application/json", strings.NewReader(body)); err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	query = map[string]string{}
+	if err := json.Unmarshal(received.Params, &query); err != nil || query["chain_id"] != "chainA" || query["path"] != "/store" {
+		t.Errorf("positional query not scoped to chain: %v (%v)", query, err)
+	}
+
+	// URI requests
+	if _, err := http.Get(server.URL + "/chainA/broadcast_tx_async?tx=0x0102"); err != nil {
+		t.Fatalf("proxy request failed: %v", err)
+	}
+	if path != "/broadcast_tx_async" || !strings.Contains(rawQuery, "tx=0x236d7578") {
+		t.Errorf("unexpected URI request forwarded: path=%s, query=%s", path, rawQuery)
+	}
+
+	// unknown chain
+	resp, err = http.Post(server.URL+"/chainB", "application/json", strings.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected request for unknown chain to fail: resp=%v, err=%v", resp, err)
+	}
+}
+
+// fakeBlockStore serves a single block
+type fakeBlockStore struct {
+	sm.BlockStore
+	block *comettypes.Block
+}
+
+func (s fakeBlockStore) Base() int64   { return 1 }
+func (s fakeBlockStore) Height() int64 { return s.block.Height }
+func (s fakeBlockStore) LoadBlock(height int64) *comettypes.Block {
+	if height != s.block.Height {
+		return nil
+	}
+	return s.block
+}
+
+func (s fakeBlockStore) LoadBlockMeta(height int64) *comettypes.BlockMeta {
+	if height != s.block.Height {
+		return nil
+	}
+	return &comettypes.BlockMeta{Header: s.block.Header}
+}
+
+func TestChainViews(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	hdlrA := &AbciHandler{ChainID: "chainA", ID: idA}
+	hdlrB := &AbciHandler{ChainID: "chainB", ID: idB}
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{idA: hdlrA, idB: hdlrB}
+	cosmux.SetAppHashStore(NewAppHashStore(dbm.NewMemDB()))
+	if err := cosmux.appHashStore.Save(1, map[ChainAppIdentifier][]byte{idA: {0xa1}, idB: {0xb1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cosmux.appHashStore.Save(2, map[ChainAppIdentifier][]byte{idA: {0xa2}, idB: {0xb2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	block := comettypes.MakeBlock(2, []comettypes.Tx{
+		append(createHeader("chainA"), 0xa0),
+		append(createHeader("chainB"), 0xb0),
+		append(createHeader("chainA"), 0xa1),
+	}, nil, nil)
+	stateStore := sm.NewStore(dbm.NewMemDB(), sm.StoreOptions{})
+	err := stateStore.SaveFinalizeBlockResponse(2, &abcitypes.ResponseFinalizeBlock{
+		TxResults: []*abcitypes.ExecTxResult{{Info: "a0"}, {Info: "b0"}, {Info: "a1"}},
+		Events: []abcitypes.Event{
+			{Type: "a", Attributes: chainAttributes(hdlrA)},
+			{Type: "b", Attributes: chainAttributes(hdlrB)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	views := NewChainViews(cosmux, fakeBlockStore{block: block}, stateStore)
+
+	result, err := views.Block(hdlrA, nil)
+	if err != nil {
+		t.Fatalf("error getting block view: %v", err)
+	}
+	if len(result.Block.Txs) != 2 || !bytes.Equal(result.Block.Txs[1], []byte{0xa1}) {
+		t.Errorf("unexpected txs in block view: %v", result.Block.Txs)
+	}
+	if !bytes.Equal(result.Block.AppHash, []byte{0xa1}) {
+		t.Errorf("unexpected app hash in block view: %X", result.Block.AppHash)
+	}
+
+	// the first block contains the app hash of InitChain
+	if err := cosmux.appHashStore.Save(0, map[ChainAppIdentifier][]byte{idA: {0xa0}, idB: {0xb0}}); err != nil {
+		t.Fatal(err)
+	}
+	first := NewChainViews(cosmux, fakeBlockStore{block: comettypes.MakeBlock(1, nil, nil, nil)}, stateStore)
+	result, err = first.Block(hdlrA, nil)
+	if err != nil || !bytes.Equal(result.Block.AppHash, []byte{0xa0}) {
+		t.Errorf("unexpected app hash in first block view: %v, %v", result, err)
+	}
+
+	height := int64(2)
+	results, err := views.BlockResults(hdlrB, &height)
+	if err != nil {
+		t.Fatalf("error getting block results view: %v", err)
+	}
+	if len(results.TxsResults) != 1 || results.TxsResults[0].Info != "b0" {
+		t.Errorf("unexpected tx results in view: %v", results.TxsResults)
+	}
+	if len(results.FinalizeBlockEvents) != 1 || results.FinalizeBlockEvents[0].Type != "b" {
+		t.Errorf("unexpected events in view: %v", results.FinalizeBlockEvents)
+	}
+	if !bytes.Equal(results.AppHash, []byte{0xb2}) {
+		t.Errorf("unexpected app hash in block results view: %X", results.AppHash)
+	}
+}
+
+func TestChainEvents(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA},
+		idB: {ChainID: "chainB", ID: idB},
+	}
+
+	eventBus := comettypes.NewEventBus()
+	if err := eventBus.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer eventBus.Stop() //nolint:errcheck
+
+	proxy, err := NewRPCProxy(cosmux, "tcp://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetChainEvents(NewChainEvents(cosmux, eventBus))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/chainA/websocket", nil)
+	if err != nil {
+		t.Fatalf("error connecting websocket: %v", err)
+	}
+	defer conn.Close()
+
+	subscribe := `{"jsonrpc":"2.0","id":1,"method":"subscribe","params":{"query":"tm.event='Tx'"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(subscribe)); err != nil {
+		t.Fatal(err)
+	}
+	response := rpcResponse{}
+	if err := conn.ReadJSON(&response); err != nil || response.Error != nil {
+		t.Fatalf("subscription failed: %v, %v", err, response.Error)
+	}
+
+	for _, tx := range [][]byte{append(createHeader("chainB"), 0xb0), append(createHeader("chainA"), 0xa0)} {
+		err := eventBus.PublishEventTx(comettypes.EventDataTx{TxResult: abcitypes.TxResult{Height: 1, Tx: tx}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the stripped tx of chainA is delivered
+	if err := conn.ReadJSON(&response); err != nil {
+		t.Fatalf("error reading event: %v", err)
+	}
+	event := ctypes.ResultEvent{}
+	if err := cmtjson.Unmarshal(response.Result, &event); err != nil {
+		t.Fatalf("error decoding event: %v", err)
+	}
+	txEvent, ok := event.Data.(comettypes.EventDataTx)
+	if !ok || !bytes.Equal(txEvent.Tx, []byte{0xa0}) {
+		t.Errorf("unexpected event delivered: %+v", event.Data)
+	}
+}
+
+// subscribeChainEvents subscribes to the events of a chain app on the websocket of the proxy
+func subscribeChainEvents(t *testing.T, url string, chainID string, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/"+chainID+"/websocket", nil)
+	if err != nil {
+		t.Fatalf("error connecting websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	subscribe, _ := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: "subscribe",
+		Params: json.RawMessage(fmt.Sprintf(`{"query":%q}`, query))})
+	if err := conn.WriteMessage(websocket.TextMessage, subscribe); err != nil {
+		t.Fatal(err)
+	}
+	response := rpcResponse{}
+	if err := conn.ReadJSON(&response); err != nil || response.Error != nil {
+		t.Fatalf("subscription failed: %v, %v", err, response.Error)
+	}
+	return conn
+}
+
+// readChainEvent reads the next event delivered on a subscription, nil if there is none
+func readChainEvent(t *testing.T, conn *websocket.Conn, wait time.Duration) *ctypes.ResultEvent {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	response := rpcResponse{}
+	if err := conn.ReadJSON(&response); err != nil {
+		return nil
+	}
+	event := &ctypes.ResultEvent{}
+	if err := cmtjson.Unmarshal(response.Result, event); err != nil {
+		t.Fatalf("error decoding event: %v", err)
+	}
+	return event
+}
+
+func TestChainEventsIsolation(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	hdlrA, hdlrB := &AbciHandler{ChainID: "chainA", ID: idA}, &AbciHandler{ChainID: "chainB", ID: idB}
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{idA: hdlrA, idB: hdlrB}
+	cosmux.SetAppHashStore(NewAppHashStore(dbm.NewMemDB()))
+	if err := cosmux.appHashStore.Save(1, map[ChainAppIdentifier][]byte{idA: {0xa1}, idB: {0xb1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventBus := comettypes.NewEventBus()
+	if err := eventBus.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer eventBus.Stop() //nolint:errcheck
+	proxy, err := NewRPCProxy(cosmux, "tcp://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetChainEvents(NewChainEvents(cosmux, eventBus))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	blockEvents := []abcitypes.Event{
+		{Type: "a", Attributes: append([]abcitypes.EventAttribute{{Key: "k", Value: "va"}}, chainAttributes(hdlrA)...)},
+		{Type: "b", Attributes: append([]abcitypes.EventAttribute{{Key: "k", Value: "vb"}}, chainAttributes(hdlrB)...)},
+	}
+	leaks := func(events map[string][]string) bool {
+		for key, values := range events {
+			for _, value := range values {
+				if strings.HasPrefix(key, "b.") || value == "chainB" || value == hex.EncodeToString(idB[:]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// block events of chainB are neither delivered nor part of the composite keys
+	conn := subscribeChainEvents(t, server.URL, "chainA", "tm.event='NewBlockEvents'")
+	if err := eventBus.PublishEventNewBlockEvents(comettypes.EventDataNewBlockEvents{Height: 2, Events: blockEvents}); err != nil {
+		t.Fatal(err)
+	}
+	event := readChainEvent(t, conn, 5*time.Second)
+	if event == nil {
+		t.Fatalf("no block events delivered")
+	}
+	data, ok := event.Data.(comettypes.EventDataNewBlockEvents)
+	if !ok || len(data.Events) != 1 || data.Events[0].Type != "a" || leaks(event.Events) || event.Events["a.k"][0] != "va" {
+		t.Errorf("events of chainB delivered to chainA: %+v, %v", event.Data, event.Events)
+	}
+
+	// queries matching only events of chainB deliver nothing
+	conn = subscribeChainEvents(t, server.URL, "chainA", "tm.event='NewBlockEvents' AND b.k EXISTS")
+	if err := eventBus.PublishEventNewBlockEvents(comettypes.EventDataNewBlockEvents{Height: 2, Events: blockEvents}); err != nil {
+		t.Fatal(err)
+	}
+	if event := readChainEvent(t, conn, 200*time.Millisecond); event != nil {
+		t.Errorf("event matching chainB only delivered to chainA: %v", event.Events)
+	}
+
+	// tx events carry the hash of the stripped tx
+	conn = subscribeChainEvents(t, server.URL, "chainA", "tm.event='Tx'")
+	tx := append(createHeader("chainA"), 0xa0)
+	result := abcitypes.ExecTxResult{Events: []abcitypes.Event{chainEvent(hdlrA)}}
+	if err := eventBus.PublishEventTx(comettypes.EventDataTx{TxResult: abcitypes.TxResult{Height: 2, Tx: tx, Result: result}}); err != nil {
+		t.Fatal(err)
+	}
+	event = readChainEvent(t, conn, 5*time.Second)
+	if event == nil {
+		t.Fatalf("no tx event delivered")
+	}
+	if hash := fmt.Sprintf("%X", comettypes.Tx([]byte{0xa0}).Hash()); len(event.Events["tx.hash"]) != 1 || event.Events["tx.hash"][0] != hash {
+		t.Errorf("unexpected tx hash of tx event: %v, want %s", event.Events["tx.hash"], hash)
+	}
+
+	// headers carry the app hash of the chain app
+	conn = subscribeChainEvents(t, server.URL, "chainA", "tm.event='NewBlockHeader'")
+	header := comettypes.Header{Height: 2, AppHash: compositeAppHash(map[ChainAppIdentifier][]byte{idA: {0xa1}, idB: {0xb1}})}
+	if err := eventBus.PublishEventNewBlockHeader(comettypes.EventDataNewBlockHeader{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+	event = readChainEvent(t, conn, 5*time.Second)
+	if event == nil {
+		t.Fatalf("no header event delivered")
+	}
+	if data, ok := event.Data.(comettypes.EventDataNewBlockHeader); !ok || !bytes.Equal(data.Header.AppHash, []byte{0xa1}) {
+		t.Errorf("unexpected header delivered to chainA: %+v", event.Data)
+	}
+}
+
+// TestRPCProxyQueryRoute forwards queries to the JSON-RPC server of CometBFT with the route of
+// abci_query of the megablocks fork, which takes the chain ID as param 'chain_id'
+func TestRPCProxyQueryRoute(t *testing.T) {
+	var chainID, path string
+	abciQuery := func(_ *rpctypes.Context, p string, _ cmtbytes.HexBytes, _ int64, _ bool, c string) (*ctypes.ResultABCIQuery, error) {
+		chainID, path = c, p
+		return &ctypes.ResultABCIQuery{}, nil
+	}
+	routes := http.NewServeMux()
+	rpcserver.RegisterRPCFuncs(routes, map[string]*rpcserver.RPCFunc{
+		"abci_query": rpcserver.NewRPCFunc(abciQuery, "path,data,height,prove,chain_id"),
+	}, cmtlog.NewNopLogger())
+	server := startRPCProxy(t, routes.ServeHTTP)
+
+	requests := []*http.Request{}
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"abci_query","params":{"path":"/named","data":"01"}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"abci_query","params":["/positional","01","0",false]}`,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/chainA/", strings.NewReader(body))
+		requests = append(requests, req)
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+`/chainA/abci_query?path="/uri"&data=0x01`, nil)
+	requests = append(requests, req)
+
+	for idx, want := range []string{"/named", "/positional", "/uri"} {
+		chainID, path = "", ""
+		resp, err := http.DefaultClient.Do(requests[idx])
+		if err != nil {
+			t.Fatalf("proxy request failed: %v", err)
+		}
+		response := rpcResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil || response.Error != nil {
+			t.Errorf("query %s failed: %v, %v", want, err, response.Error)
+		}
+		resp.Body.Close()
+		if chainID != "chainA" || path != want {
+			t.Errorf("unexpected query received by CometBFT: chain-id=%s, path=%s, want %s", chainID, path, want)
+		}
+	}
+}
+
+// fakeMempool holds a fixed list of pending transactions
+type fakeMempool comettypes.Txs
+
+func (m fakeMempool) ReapMaxTxs(max int) comettypes.Txs { return comettypes.Txs(m) }
+
+// checkingMempool records a CheckTx while reaping, as CometBFT does when CheckTx
+// runs under the lock of the mempool
+type checkingMempool struct {
+	fakeMempool
+	tracker *MempoolTracker
+	id      ChainAppIdentifier
+}
+
+func (m checkingMempool) ReapMaxTxs(max int) comettypes.Txs {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.tracker.RecordCheckTx(m.id, m.fakeMempool[0], abcitypes.CheckTxType_New, true)
+	}()
+	<-done
+	return m.fakeMempool.ReapMaxTxs(max)
+}
+
+func TestMempoolStatsLockOrder(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	idA := getChainAppIdentifier("chainA")
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{idA: {ChainID: "chainA", ID: idA}}
+	mempool := checkingMempool{fakeMempool: fakeMempool{append(createHeader("chainA"), 0xa1)}, tracker: cosmux.mempoolTracker, id: idA}
+
+	stats := cosmux.MempoolStats(mempool)
+	if len(stats) != 1 || stats[0].PendingTxs != 1 || stats[0].CheckTxAccepted != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMempoolStats(t *testing.T) {
+	cosmux := NewMultiplexer(
+		&CosmuxConfig{LogLevel: "debug"},
+	)
+	idA, idB := getChainAppIdentifier("chainA"), getChainAppIdentifier("chainB")
+	cosmux.clients = map[ChainAppIdentifier]*AbciHandler{
+		idA: {ChainID: "chainA", ID: idA},
+		idB: {ChainID: "chainB", ID: idB},
+	}
+
+	txA1, txA2 := append(createHeader("chainA"), 0xa1), append(createHeader("chainA"), 0xa2, 0xa2)
+	txB := append(createHeader("chainB"), 0xb1)
+	tracker := cosmux.mempoolTracker
+	tracker.RecordCheckTx(idA, txA1, abcitypes.CheckTxType_New, true)
+	tracker.RecordCheckTx(idA, txA2, abcitypes.CheckTxType_New, true)
+	tracker.RecordCheckTx(idB, txB, abcitypes.CheckTxType_New, true)
+	tracker.RecordCheckTx(idB, append(createHeader("chainB"), 0xb2), abcitypes.CheckTxType_New, false)
+	tracker.RecordCheckTx(idB, txB, abcitypes.CheckTxType_Recheck, false)
+	if len(tracker.firstSeen) != 2 {
+		t.Errorf("rejected txs not dropped from tracker: %d entries", len(tracker.firstSeen))
+	}
+
+	proxy, err := NewRPCProxy(cosmux, "tcp://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.SetMempool(fakeMempool{txA1, txA2})
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + MempoolStatsPath)
+	if err != nil {
+		t.Fatalf("mempool stats request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	stats := []AppMempoolStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("error decoding mempool stats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected stats of 2 chain apps, got %v", stats)
+	}
+
+	statsA, statsB := stats[0], stats[1]
+	if statsA.ChainID != "chainA" || statsA.PendingTxs != 2 || statsA.PendingBytes != int64(len(txA1)+len(txA2)) ||
+		statsA.CheckTxAccepted != 2 || statsA.OldestAgeSecs <= 0 {
+		t.Errorf("unexpected stats of chainA: %+v", statsA)
+	}
+	if statsB.ChainID != "chainB" || statsB.PendingTxs != 0 || statsB.CheckTxAccepted != 1 ||
+		statsB.CheckTxRejected != 1 || statsB.RecheckRejected != 1 {
+		t.Errorf("unexpected stats of chainB: %+v", statsB)
+	}
+
+	// transactions which left the mempool otherwise, e.g. evicted, are pruned after the grace period
+	evicted := append(createHeader("chainA"), 0xa3)
+	tracker.RecordCheckTx(idA, evicted, abcitypes.CheckTxType_New, true)
+	tracker.firstSeen[string(comettypes.Tx(evicted).Hash())] = time.Now().Add(-2 * mempoolPruneGrace)
+	tracker.firstSeen[string(comettypes.Tx(txA2).Hash())] = time.Now().Add(-2 * mempoolPruneGrace)
+	tracker.firstSeen[string(comettypes.Tx(txB).Hash())] = time.Now()
+
+	// the breakdown is served via ABCI query as well
+	cosmux.SetMempool(fakeMempool{txA1})
+	query, err := cosmux.Query(context.Background(), &abcitypes.RequestQuery{Path: QueryPathMempool})
+	if err != nil || !query.IsOK() {
+		t.Fatalf("mempool query failed: %v, %v", query, err)
+	}
+	if err := json.Unmarshal(query.Value, &stats); err != nil || len(stats) != 2 || stats[0].PendingTxs != 1 {
+		t.Errorf("unexpected stats of mempool query: %+v, %v", stats, err)
+	}
+	if _, exists := tracker.firstSeen[string(comettypes.Tx(evicted).Hash())]; exists || len(tracker.firstSeen) != 2 {
+		t.Errorf("expected evicted txs to be pruned and recent ones to be kept: %d entries", len(tracker.firstSeen))
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// Kinds of divergences of a shadow chain app
+const (
+	DivergenceTxResult = "tx_result"
+	DivergenceAppHash  = "app_hash"
+	DivergenceError    = "error"
+)
+
+// defaultShadowQueueSize is the number of calls a shadow may lag behind its primary if not configured
+const defaultShadowQueueSize = 64
+
+// QueryPathShadows is the ABCI query path of the status of the shadow chain apps
+const QueryPathShadows = "/megablocks/shadows"
+
+// ShadowStatus is the status of a shadow chain app
+type ShadowStatus struct {
+	ChainID     string `json:"chain_id"`
+	QueuedCalls int    `json:"queued_calls"`
+	QueueSize   int    `json:"queue_size"`
+	Stopped     bool   `json:"stopped"`
+	StoppedAt   int64  `json:"stopped_at,omitempty"` // height the first call was dropped at
+}
+
+// shadowRunner forwards the calls to a shadow in order on its own goroutine,
+// so a slow or hung shadow never blocks the chain apps reaching consensus
+type shadowRunner struct {
+	*AbciHandler
+	calls     chan func(ctx context.Context)
+	stopped   atomic.Bool  // set when the shadow fell behind and no longer receives calls
+	stoppedAt atomic.Int64 // height the shadow was stopped at
+}
+
+func (s *shadowRunner) run() {
+	for call := range s.calls {
+		call(context.Background())
+	}
+}
+
+// addShadow registers a shadow of an already registered chain app. The shadow receives
+// the same InitChain, FinalizeBlock and Commit calls, but its responses never reach consensus.
+func (mux *CometMux) addShadow(hdlr *AbciHandler) error {
+	if _, exists := mux.clients[hdlr.ID]; !exists {
+		return fmt.Errorf("no chain app '%s' registered to be shadowed", hdlr.ChainID)
+	}
+	if _, exists := mux.shadows[hdlr.ID]; exists {
+		return fmt.Errorf("shadow of chain app '%s' exists already", hdlr.ChainID)
+	}
+	mux.log.Info("Adding shadow handler", "chain-id", hdlr.ChainID)
+	queueSize := mux.cfg.ShadowQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultShadowQueueSize
+	}
+	shadow := &shadowRunner{AbciHandler: hdlr, calls: make(chan func(ctx context.Context), queueSize)}
+	go shadow.run()
+	mux.shadows[hdlr.ID] = shadow
+	return nil
+}
+
+// enqueueShadow queues a call of the shadow without waiting. A shadow whose queue is full
+// cannot follow its primary any more and is stopped. It is reported by the metric
+// 'shadow_stopped' and the status on QueryPathShadows, and must be restarted from a
+// copy of the primary's state.
+func (mux *CometMux) enqueueShadow(shadow *shadowRunner, height int64, call func(ctx context.Context)) {
+	if shadow.stopped.Load() {
+		return
+	}
+	select {
+	case shadow.calls <- call:
+		mux.metrics.ShadowQueuedCalls.With("chain_id", shadow.ChainID).Set(float64(len(shadow.calls)))
+	default:
+		shadow.stoppedAt.Store(height)
+		shadow.stopped.Store(true)
+		mux.metrics.ShadowStopped.With("chain_id", shadow.ChainID).Set(1)
+		mux.divergence(shadow.AbciHandler, height, DivergenceError, "error", "shadow fell behind and is stopped")
+	}
+}
+
+// ShadowStatus returns the status of all shadow chain apps sorted by chain ID
+func (mux *CometMux) ShadowStatus() []ShadowStatus {
+	status := []ShadowStatus{}
+	for _, shadow := range mux.shadows {
+		status = append(status, ShadowStatus{
+			ChainID:     shadow.ChainID,
+			QueuedCalls: len(shadow.calls),
+			QueueSize:   cap(shadow.calls),
+			Stopped:     shadow.stopped.Load(),
+			StoppedAt:   shadow.stoppedAt.Load(),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ChainID < status[j].ChainID })
+	return status
+}
+
+// queryShadows answers queries on QueryPathShadows
+func (mux *CometMux) queryShadows() *abcitypes.ResponseQuery {
+	value, err := json.Marshal(mux.ShadowStatus())
+	if err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	return &abcitypes.ResponseQuery{Value: value}
+}
+
+// SetMetrics sets the metrics reported by the multiplexer
+func (mux *CometMux) SetMetrics(metrics *Metrics) {
+	mux.metrics = metrics
+}
+
+// divergence logs and counts a divergence of a shadow from its primary
+func (mux *CometMux) divergence(shadow *AbciHandler, height int64, kind string, keyvals ...interface{}) {
+	mux.log.Error("Shadow diverges from primary",
+		append([]interface{}{"chain-id", shadow.ChainID, "height", height, "kind", kind}, keyvals...)...)
+	mux.metrics.ShadowDivergences.With("chain_id", shadow.ChainID, "kind", kind).Add(1)
+}
+
+// shadowFinalizeBlock queues FinalizeBlock for the shadow of the chain app, if any.
+// The response of the shadow is compared to the one of the primary when it arrives.
+func (mux *CometMux) shadowFinalizeBlock(id ChainAppIdentifier, req *abcitypes.RequestFinalizeBlock,
+	primary *abcitypes.ResponseFinalizeBlock,
+) {
+	shadow, exists := mux.shadows[id]
+	if !exists {
+		return
+	}
+	// the primary response is tagged and combined while the shadow executes
+	primary = &abcitypes.ResponseFinalizeBlock{
+		TxResults: append([]*abcitypes.ExecTxResult{}, primary.TxResults...),
+		AppHash:   primary.AppHash,
+	}
+	mux.enqueueShadow(shadow, req.Height, func(ctx context.Context) {
+		if shadow.lateJoining() && req.Height == shadow.ActivationHeight {
+			if _, err := activateChainApp(ctx, shadow.AbciHandler, req); err != nil {
+				mux.divergence(shadow.AbciHandler, req.Height, DivergenceError, "error", err)
+				return
+			}
+		}
+		resp, err := shadow.consensus().FinalizeBlock(ctx, req)
+		if err != nil {
+			mux.divergence(shadow.AbciHandler, req.Height, DivergenceError, "error", err)
+			return
+		}
+		if shadow.SiblingHashes && len(resp.TxResults) > 0 {
+			resp.TxResults = resp.TxResults[1:]
+		}
+		mux.compareShadow(shadow.AbciHandler, req.Height, primary, resp)
+	})
+}
+
+// compareShadow reports the differences of the shadow response to the one of the primary
+func (mux *CometMux) compareShadow(shadow *AbciHandler, height int64, primary, shadowResp *abcitypes.ResponseFinalizeBlock) {
+	if len(primary.TxResults) != len(shadowResp.TxResults) {
+		mux.divergence(shadow, height, DivergenceTxResult,
+			"primary-results", len(primary.TxResults), "shadow-results", len(shadowResp.TxResults))
+	} else {
+		for idx := range primary.TxResults {
+			if !equalTxResult(primary.TxResults[idx], shadowResp.TxResults[idx]) {
+				mux.divergence(shadow, height, DivergenceTxResult, "index", idx,
+					"primary", primary.TxResults[idx], "shadow", shadowResp.TxResults[idx])
+			}
+		}
+	}
+	if !bytes.Equal(primary.AppHash, shadowResp.AppHash) {
+		mux.divergence(shadow, height, DivergenceAppHash,
+			"primary", fmt.Sprintf("%X", primary.AppHash), "shadow", fmt.Sprintf("%X", shadowResp.AppHash))
+	}
+}
+
+// equalTxResult compares the deterministic fields of tx results which are part of the results hash
+func equalTxResult(a, b *abcitypes.ExecTxResult) bool {
+	return a.Code == b.Code && bytes.Equal(a.Data, b.Data) && a.GasWanted == b.GasWanted && a.GasUsed == b.GasUsed
+}
+
+// shadowCommit queues Commit for all shadows, failures are only reported
+func (mux *CometMux) shadowCommit(commit *abcitypes.RequestCommit) {
+	height := mux.finalizedHeight
+	for _, shadow := range mux.shadows {
+		if !shadow.activeAt(height) || mux.skippedApps[shadow.ID] {
+			continue
+		}
+		shadow := shadow
+		mux.enqueueShadow(shadow, height, func(ctx context.Context) {
+			if _, err := shadow.consensus().Commit(ctx, commit); err != nil {
+				mux.divergence(shadow.AbciHandler, height, DivergenceError, "error", err)
+			}
+		})
+	}
+}
+
+// shadowInitChain queues InitChain for all shadows, failures are only reported
+func (mux *CometMux) shadowInitChain(chain *abcitypes.RequestInitChain) {
+	for _, shadow := range mux.shadows {
+		if !shadow.activeAt(chain.InitialHeight) {
+			continue
+		}
+		shadow := shadow
+		mux.enqueueShadow(shadow, chain.InitialHeight, func(ctx context.Context) {
+			if _, err := shadow.InitChain(ctx, chain); err != nil {
+				mux.divergence(shadow.AbciHandler, chain.InitialHeight, DivergenceError, "error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// SysMAGIC marks system transactions created by the multiplexer
+var SysMAGIC = [...]byte{0x23, 0x6d, 0x75, 0x73}
+
+// SiblingAppHash is the app hash of a chain app at a given height
+type SiblingAppHash struct {
+	ID      string `json:"id"` // hex encoded ChainAppIdentifier
+	ChainID string `json:"chain_id"`
+	AppHash []byte `json:"app_hash"`
+}
+
+// SiblingInfo is delivered as system transaction at the start of each block
+// to chain apps which opted in. It contains the app hashes of all chain apps
+// of the previous height ordered by ChainAppIdentifier.
+type SiblingInfo struct {
+	Height int64            `json:"height"`
+	Apps   []SiblingAppHash `json:"apps"`
+}
+
+// IsSystemTx returns true if tx is a system transaction created by the multiplexer
+func IsSystemTx(tx []byte) bool {
+	return len(tx) >= len(SysMAGIC) && string(tx[:len(SysMAGIC)]) == string(SysMAGIC[:])
+}
+
+// forgesSystemTx returns true if the stripped transaction of a chain app receiving sibling
+// app hashes could not be told apart from the system transaction of the multiplexer
+func (hdl *AbciHandler) forgesSystemTx(tx []byte) bool {
+	return hdl.SiblingHashes && IsSystemTx(StripHeader(tx))
+}
+
+// systemTxAt returns true if the multiplexer delivers a system transaction to the chain app at the
+// given height. Chain apps receiving sibling app hashes get them at every height they are active at.
+func (hdl *AbciHandler) systemTxAt(height int64) bool {
+	return hdl.SiblingHashes && hdl.activeAt(height)
+}
+
+// siblingInfoTx creates the system transaction with the app hashes of the previous height
+func (mux *CometMux) siblingInfoTx(height int64) ([]byte, error) {
+	mux.stateMtx.RLock()
+	defer mux.stateMtx.RUnlock()
+
+	ids := mapKeys(mux.appHashes)
+	SortChainAppIDs(ids)
+
+	info := SiblingInfo{Height: height - 1, Apps: []SiblingAppHash{}}
+	for _, id := range ids {
+		chainID := ""
+		if hdlr, exists := mux.clients[id]; exists {
+			chainID = hdlr.ChainID
+		}
+		info.Apps = append(info.Apps, SiblingAppHash{
+			ID:      hex.EncodeToString(id[:]),
+			ChainID: chainID,
+			AppHash: mux.appHashes[id],
+		})
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return append(SysMAGIC[:], data...), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcicli "github.com/cometbft/cometbft/abci/client"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// A sparse chain app is only driven on heights with its own transactions and at its activation.
+// It sees a gapless sequence of its own heights which are mapped to the heights of the multiplexer.
+// On skipped heights its last app hash is reused for the composite app hash.
+
+// SparseHeights maps the heights of a sparse chain app to the heights of the multiplexer
+type SparseHeights struct {
+	mtx     sync.RWMutex
+	id      ChainAppIdentifier
+	db      dbm.DB
+	heights []int64 // height of the multiplexer of each height of the chain app
+	pending int64   // height of the multiplexer finalized but not committed yet
+}
+
+// NewSparseHeights creates an empty height mapping of a chain app
+func NewSparseHeights(id ChainAppIdentifier) *SparseHeights {
+	return &SparseHeights{id: id, heights: []int64{}}
+}
+
+func sparseHeightKey(id ChainAppIdentifier, appHeight int64) []byte {
+	key := append([]byte("sparse:"), id[:]...)
+	return binary.BigEndian.AppendUint64(key, uint64(appHeight))
+}
+
+// Load attaches the mapping to the database and reads the recorded heights
+func (s *SparseHeights) Load(db dbm.DB) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	it, err := dbm.IteratePrefix(db, append([]byte("sparse:"), s.id[:]...))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	heights := []int64{}
+	for ; it.Valid(); it.Next() {
+		heights = append(heights, int64(binary.BigEndian.Uint64(it.Value())))
+	}
+	s.db = db
+	s.heights = heights
+	return nil
+}
+
+// appHeight returns the height of the chain app for a block executed at the given height
+func (s *SparseHeights) appHeight(height int64) int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	idx := sort.Search(len(s.heights), func(i int) bool { return s.heights[i] >= height })
+	if idx < len(s.heights) && s.heights[idx] == height {
+		return int64(idx + 1)
+	}
+	return int64(len(s.heights) + 1)
+}
+
+// stateHeight returns the height of the chain app's state at the given height, 0 if it has none
+func (s *SparseHeights) stateHeight(height int64) int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return int64(sort.Search(len(s.heights), func(i int) bool { return s.heights[i] > height }))
+}
+
+// muxHeight returns the height of the multiplexer of a height of the chain app
+func (s *SparseHeights) muxHeight(appHeight int64) int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if appHeight <= 0 || appHeight > int64(len(s.heights)) {
+		return appHeight
+	}
+	return s.heights[appHeight-1]
+}
+
+// finalized remembers the height executed by the chain app
+func (s *SparseHeights) finalized(height int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pending = height
+}
+
+// committing records the executed height as next height of the chain app. It is called before
+// the chain app commits, so a crash in between leaves a mapping of the height the chain app
+// executes again on recovery instead of a chain app ahead of its mapping.
+func (s *SparseHeights) committing() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	height := s.pending
+	s.pending = 0
+	if height == 0 || (len(s.heights) > 0 && s.heights[len(s.heights)-1] >= height) {
+		// height executed again after a restart
+		return nil
+	}
+	s.heights = append(s.heights, height)
+	if s.db == nil {
+		return nil
+	}
+	return s.db.SetSync(sparseHeightKey(s.id, int64(len(s.heights))), binary.BigEndian.AppendUint64(nil, uint64(height)))
+}
+
+// SetSparseHeightStore records the height mappings of all sparse chain apps in the given database
+func (mux *CometMux) SetSparseHeightStore(db dbm.DB) error {
+	for _, hdlr := range mux.clients {
+		if hdlr.sparse == nil {
+			continue
+		}
+		if err := hdlr.sparse.Load(db); err != nil {
+			return fmt.Errorf("error loading heights of '%s': %v", hdlr.ChainID, err)
+		}
+	}
+	return nil
+}
+
+// committingApps returns the sorted identifiers of the chain apps which executed the finalized height
+func (mux *CometMux) committingApps() []ChainAppIdentifier {
+	ids := []ChainAppIdentifier{}
+	for _, id := range mux.activeChainApps(mux.finalizedHeight) {
+		if !mux.skippedApps[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// skippedAt returns true if a sparse chain app is not driven at the given height. A sparse chain
+// app is driven on heights with its transactions, at its activation and on heights with system
+// transactions addressed to it. The rule is shared by block execution, replay and rebuild.
+func (hdl *AbciHandler) skippedAt(height int64, slots []int) bool {
+	return hdl.sparse != nil && len(slots) == 0 && !hdl.systemTxAt(height) && !(hdl.lateJoining() && height == hdl.ActivationHeight)
+}
+
+// drivenHeight returns the last height up to the given height the chain app was driven at.
+// Chain apps which are not sparse are driven at every height they are not paused at.
+func (hdl *AbciHandler) drivenHeight(height int64) int64 {
+	if hdl.sparse == nil {
+		return hdl.unpausedHeight(height - hdl.pausedBefore(height+1))
+	}
+	return hdl.sparse.muxHeight(hdl.sparse.stateHeight(height))
+}
+
+// sparseHeightClient translates the heights of the multiplexer into the heights of a sparse
+// chain app and back
+type sparseHeightClient struct {
+	abcicli.Client
+	heights *SparseHeights
+}
+
+func (c *sparseHeightClient) Info(ctx context.Context, req *abcitypes.RequestInfo) (*abcitypes.ResponseInfo, error) {
+	resp, err := c.Client.Info(ctx, req)
+	if err == nil {
+		resp.LastBlockHeight = c.heights.muxHeight(resp.LastBlockHeight)
+	}
+	return resp, err
+}
+
+func (c *sparseHeightClient) Query(ctx context.Context, req *abcitypes.RequestQuery) (*abcitypes.ResponseQuery, error) {
+	if isControlQuery(req.Path) {
+		return c.Client.Query(ctx, req)
+	}
+	appReq := *req
+	if req.Height > 0 {
+		if appReq.Height = c.heights.stateHeight(req.Height); appReq.Height == 0 {
+			return &abcitypes.ResponseQuery{
+				Code:      CodeQueryFailed,
+				Codespace: MegablocksCodespace,
+				Log:       fmt.Sprintf("no state of chain app at height %d", req.Height),
+			}, nil
+		}
+	}
+	resp, err := c.Client.Query(ctx, &appReq)
+	if err == nil {
+		resp.Height = c.heights.muxHeight(resp.Height)
+	}
+	return resp, err
+}
+
+func (c *sparseHeightClient) ProcessProposal(ctx context.Context, req *abcitypes.RequestProcessProposal) (*abcitypes.ResponseProcessProposal, error) {
+	appReq := *req
+	appReq.Height = c.heights.appHeight(req.Height)
+	return c.Client.ProcessProposal(ctx, &appReq)
+}
+
+func (c *sparseHeightClient) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+	appReq := *req
+	appReq.Height = c.heights.appHeight(req.Height)
+	resp, err := c.Client.FinalizeBlock(ctx, &appReq)
+	if err == nil {
+		c.heights.finalized(req.Height)
+	}
+	return resp, err
+}
+
+func (c *sparseHeightClient) Commit(ctx context.Context, req *abcitypes.RequestCommit) (*abcitypes.ResponseCommit, error) {
+	if err := c.heights.committing(); err != nil {
+		return nil, fmt.Errorf("error recording height: %v", err)
+	}
+	resp, err := c.Client.Commit(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	resp.RetainHeight = c.heights.muxHeight(resp.RetainHeight)
+	return resp, nil
+}
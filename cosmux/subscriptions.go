@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtjson "github.com/cometbft/cometbft/libs/json"
+	cmtpubsub "github.com/cometbft/cometbft/libs/pubsub"
+	cmtquery "github.com/cometbft/cometbft/libs/pubsub/query"
+	ctypes "github.com/cometbft/cometbft/rpc/core/types"
+	comettypes "github.com/cometbft/cometbft/types"
+	"github.com/gorilla/websocket"
+)
+
+// subscriptionBufferSize is the capacity of a subscription to the event bus
+const subscriptionBufferSize = 100
+
+// EventSubscriber is the subscription interface of the CometBFT event bus
+type EventSubscriber interface {
+	Subscribe(ctx context.Context, subscriber string, query cmtpubsub.Query, outCapacity ...int) (comettypes.Subscription, error)
+	Unsubscribe(ctx context.Context, subscriber string, query cmtpubsub.Query) error
+	UnsubscribeAll(ctx context.Context, subscriber string) error
+}
+
+// ChainEvents serves CometBFT compatible websocket subscriptions on the events of a single chain app.
+// Tx events of other chain apps are dropped, transactions are delivered without Megablocks header
+// and NewBlock events contain only the transactions, results and events of the chain app. Block
+// headers carry the app hash of the chain app. The composite keys of each delivered event are
+// derived from the chain app's view of the event only, and the subscription query is matched again
+// against them.
+type ChainEvents struct {
+	mux      *CometMux
+	bus      EventSubscriber
+	upgrader websocket.Upgrader
+}
+
+// NewChainEvents creates per-chain subscriptions on the given event bus
+func NewChainEvents(mux *CometMux, bus EventSubscriber) *ChainEvents {
+	return &ChainEvents{
+		mux: mux,
+		bus: bus,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// wsConnection serializes writes on a websocket connection
+type wsConnection struct {
+	conn *websocket.Conn
+	mtx  sync.Mutex
+}
+
+func (c *wsConnection) write(response rpcResponse) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn.WriteJSON(response)
+}
+
+func (c *wsConnection) writeResult(id json.RawMessage, result interface{}) error {
+	data, err := cmtjson.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return c.write(rpcResponse{JSONRPC: "2.0", ID: id, Result: data})
+}
+
+func (c *wsConnection) writeError(id json.RawMessage, code int, err error) error {
+	return c.write(rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: "Internal error", Data: err.Error()}})
+}
+
+// ServeWebsocket handles the websocket connection of a client of the given chain app
+func (e *ChainEvents) ServeWebsocket(w http.ResponseWriter, r *http.Request, hdlr *AbciHandler) {
+	conn, err := e.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		e.mux.log.Error("error upgrading websocket connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ws := &wsConnection{conn: conn}
+	subscriber := fmt.Sprintf("megablocks-%s@%s", hdlr.ChainID, r.RemoteAddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		_ = e.bus.UnsubscribeAll(context.Background(), subscriber)
+	}()
+
+	for {
+		req := rpcRequest{}
+		if err := conn.ReadJSON(&req); err != nil {
+			e.mux.log.Debug("websocket connection closed", "subscriber", subscriber, "error", err)
+			return
+		}
+
+		params := map[string]string{}
+		if req.Method != "unsubscribe_all" {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				_ = ws.writeError(req.ID, -32602, fmt.Errorf("invalid params: %v", err))
+				continue
+			}
+		}
+
+		switch req.Method {
+		case "subscribe":
+			query, err := cmtquery.New(params["query"])
+			if err != nil {
+				_ = ws.writeError(req.ID, -32602, fmt.Errorf("invalid query: %v", err))
+				continue
+			}
+			sub, err := e.bus.Subscribe(ctx, subscriber, query, subscriptionBufferSize)
+			if err != nil {
+				_ = ws.writeError(req.ID, -32603, err)
+				continue
+			}
+			go e.forward(ctx, ws, req.ID, query, sub, hdlr)
+			err = ws.writeResult(req.ID, &ctypes.ResultSubscribe{})
+
+		case "unsubscribe":
+			query, err := cmtquery.New(params["query"])
+			if err == nil {
+				err = e.bus.Unsubscribe(ctx, subscriber, query)
+			}
+			if err != nil {
+				_ = ws.writeError(req.ID, -32603, err)
+				continue
+			}
+			err = ws.writeResult(req.ID, &ctypes.ResultUnsubscribe{})
+
+		case "unsubscribe_all":
+			if err := e.bus.UnsubscribeAll(ctx, subscriber); err != nil {
+				_ = ws.writeError(req.ID, -32603, err)
+				continue
+			}
+			err = ws.writeResult(req.ID, &ctypes.ResultUnsubscribe{})
+
+		default:
+			err = ws.writeError(req.ID, -32601, fmt.Errorf("method '%s' not supported", req.Method))
+		}
+		if err != nil {
+			e.mux.log.Error("error writing websocket response", "subscriber", subscriber, "error", err)
+			return
+		}
+	}
+}
+
+// forward delivers the events of a subscription relevant for the chain app
+func (e *ChainEvents) forward(ctx context.Context, ws *wsConnection, id json.RawMessage, query cmtpubsub.Query,
+	sub comettypes.Subscription, hdlr *AbciHandler,
+) {
+	for {
+		select {
+		case msg := <-sub.Out():
+			data, events, relevant := e.chainEventData(hdlr, msg.Data(), msg.Events())
+			if !relevant {
+				continue
+			}
+			if matches, err := query.Matches(events); err != nil || !matches {
+				continue
+			}
+			result := &ctypes.ResultEvent{Query: query.String(), Data: data, Events: events}
+			if err := ws.writeResult(id, result); err != nil {
+				e.mux.log.Error("error writing event", "chain-id", hdlr.ChainID, "error", err)
+				return
+			}
+		case <-sub.Canceled():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// chainEventData returns the event data and composite keys as seen by the chain app and whether
+// the event is relevant for the chain app at all
+func (e *ChainEvents) chainEventData(hdlr *AbciHandler, data comettypes.TMEventData, events map[string][]string,
+) (comettypes.TMEventData, map[string][]string, bool) {
+	switch event := data.(type) {
+	case comettypes.EventDataTx:
+		if !e.mux.isChainTx(hdlr, event.Tx) {
+			return nil, nil, false
+		}
+		event.Tx = StripHeader(event.Tx)
+		chainEvents := stringifyEvents(event.Result.Events, comettypes.EventTx)
+		chainEvents[comettypes.TxHashKey] = []string{fmt.Sprintf("%X", comettypes.Tx(event.Tx).Hash())}
+		chainEvents[comettypes.TxHeightKey] = []string{fmt.Sprintf("%d", event.Height)}
+		return event, chainEvents, true
+
+	case comettypes.EventDataNewBlock:
+		header, ok := e.chainHeader(hdlr, event.Block.Header)
+		if !ok {
+			return nil, nil, false
+		}
+		results := event.ResultFinalizeBlock
+		results.TxResults = e.mux.chainTxResults(hdlr, event.Block.Txs, results.TxResults)
+		results.Events = chainEvents(hdlr, results.Events)
+		block := e.mux.chainBlock(hdlr, event.Block)
+		block.Header = header
+		return comettypes.EventDataNewBlock{
+			Block:               block,
+			BlockID:             event.BlockID,
+			ResultFinalizeBlock: results,
+		}, stringifyEvents(results.Events, comettypes.EventNewBlock), true
+
+	case comettypes.EventDataNewBlockEvents:
+		event.Events = chainEvents(hdlr, event.Events)
+		return event, stringifyEvents(event.Events, comettypes.EventNewBlockEvents), true
+
+	case comettypes.EventDataNewBlockHeader:
+		header, ok := e.chainHeader(hdlr, event.Header)
+		if !ok {
+			return nil, nil, false
+		}
+		event.Header = header
+		return event, events, true
+	}
+	// consensus events are the same for all chain apps
+	return data, events, true
+}
+
+// chainHeader returns the header with the app hash of the chain app resulting from the
+// previous height. Headers are dropped if the app hash is not recorded.
+func (e *ChainEvents) chainHeader(hdlr *AbciHandler, header comettypes.Header) (comettypes.Header, bool) {
+	if e.mux.appHashStore == nil {
+		return header, false
+	}
+	appHash, err := e.mux.appHashStore.Load(header.Height-1, hdlr.ID)
+	if err != nil {
+		e.mux.log.Debug("dropping header event without app hash", "chain-id", hdlr.ChainID, "height", header.Height, "error", err)
+		return header, false
+	}
+	header.AppHash = appHash
+	return header, true
+}
+
+// stringifyEvents returns the composite keys of the given events as the CometBFT event bus
+// derives them, together with the event type
+func stringifyEvents(events []abcitypes.Event, eventType string) map[string][]string {
+	result := map[string][]string{comettypes.EventTypeKey: {eventType}}
+	for _, event := range events {
+		if len(event.Type) == 0 {
+			continue
+		}
+		for _, attr := range event.Attributes {
+			if len(attr.Key) == 0 {
+				continue
+			}
+			compositeTag := fmt.Sprintf("%s.%s", event.Type, attr.Key)
+			result[compositeTag] = append(result[compositeTag], attr.Value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// A chain app with a sunset height in the megablocks genesis executes its last block at the height
+// before. From the sunset height on its transactions are rejected and its final app hash stays
+// frozen in the composite app hash. Once its last height is committed, the state of the chain app
+// is exported, so it can be reused elsewhere, and the connections to the chain app are closed. The
+// chain app stays registered, so its transactions are rejected and its app hash is known. A node
+// which was down or catching up at that height exports the state on startup or its next commit.
+
+// QueryPathExport is the ABCI query path asking a chain app for the export of its state at the
+// query height. The value of the response is written to the export directory.
+const QueryPathExport = "/megablocks/export"
+
+// exportTimeout is the budget of a chain app to export its state
+const exportTimeout = 10 * time.Minute
+
+// sunsetAt returns true if the chain app is retired at the given height
+func (hdl *AbciHandler) sunsetAt(height int64) bool {
+	return hdl.SunsetHeight > 0 && height >= hdl.SunsetHeight
+}
+
+// lastActiveHeight returns the last height the chain app executes, 0 if it has no sunset
+func (hdl *AbciHandler) lastActiveHeight() int64 {
+	if hdl.SunsetHeight == 0 {
+		return 0
+	}
+	return hdl.SunsetHeight - 1
+}
+
+// exportFile returns the file of the export of the chain app at the given height
+func (mux *CometMux) exportFile(hdlr *AbciHandler, height int64) string {
+	return filepath.Join(mux.cfg.ExportDir, fmt.Sprintf("%s-%d.json", hdlr.ChainID, height))
+}
+
+// exportSunsetApps starts the export of the retired chain apps whose last height is committed
+// at the given height and which have no export yet. Exported chain apps are disconnected.
+func (mux *CometMux) exportSunsetApps(height int64) {
+	for _, hdlr := range mux.clients {
+		last := hdlr.lastActiveHeight()
+		if last == 0 || last > height || hdlr.retired.Load() {
+			continue
+		}
+		if mux.cfg.ExportDir == "" {
+			mux.retireChainApp(hdlr)
+			continue
+		}
+		if _, err := os.Stat(mux.exportFile(hdlr, last)); err == nil {
+			mux.retireChainApp(hdlr)
+			continue
+		}
+		if _, running := mux.exports.LoadOrStore(hdlr.ID, true); running {
+			continue
+		}
+		go func(hdlr *AbciHandler) {
+			defer mux.exports.Delete(hdlr.ID)
+			ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+			defer cancel()
+			if err := mux.ExportChainApp(ctx, hdlr, last); err != nil {
+				mux.log.Error("error exporting chain app", "chain-id", hdlr.ChainID, "height", last, "error", err)
+				return
+			}
+			mux.retireChainApp(hdlr)
+		}(hdlr)
+	}
+}
+
+// retireChainApp closes the connections of a retired chain app and of its replicas
+func (mux *CometMux) retireChainApp(hdlr *AbciHandler) {
+	if err := hdlr.closeConnections(); err != nil {
+		mux.log.Error("error disconnecting retired chain app", "chain-id", hdlr.ChainID, "error", err)
+	}
+	hdlr.replicas.Stop()
+	mux.log.Info("Disconnected retired chain app", "chain-id", hdlr.ChainID)
+}
+
+// ExportChainApp writes the export of the chain app's state at the given height to the export directory
+func (mux *CometMux) ExportChainApp(ctx context.Context, hdlr *AbciHandler, height int64) error {
+	if mux.cfg.ExportDir == "" {
+		return fmt.Errorf("no export directory configured")
+	}
+	resp, err := hdlr.query().Query(ctx, &abcitypes.RequestQuery{ChainId: hdlr.ChainID, Path: QueryPathExport, Height: height})
+	if err != nil {
+		return err
+	}
+	if resp.IsErr() {
+		return fmt.Errorf("code %d: %s", resp.Code, resp.Log)
+	}
+	if err := os.MkdirAll(mux.cfg.ExportDir, 0o700); err != nil {
+		return err
+	}
+	file := mux.exportFile(hdlr, height)
+	if err := os.WriteFile(file, resp.Value, 0o600); err != nil {
+		return err
+	}
+	mux.log.Info("Exported chain app", "chain-id", hdlr.ChainID, "height", height, "file", file)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// Query paths of the two-phase commit protocol between the multiplexer and the chain apps.
+// The query height is the height of the chain app, the query data is the same height as 8 byte
+// big endian integer. The calls are sent on the consensus connection and are not subject to the
+// height translation of sparse, late joining or paused chain apps.
+const (
+	// QueryPathPrepareCommit asks the chain app to make sure the finalized height can be
+	// committed, e.g. by writing it to a state which can still be discarded
+	QueryPathPrepareCommit = "/megablocks/commit/prepare"
+	// QueryPathRollback asks the chain app to discard a prepared height or to roll back a
+	// committed height, so the height can be executed again
+	QueryPathRollback = "/megablocks/commit/rollback"
+)
+
+// isControlQuery returns true for the two-phase commit queries, which carry the height of the chain app
+func isControlQuery(path string) bool {
+	return path == QueryPathPrepareCommit || path == QueryPathRollback
+}
+
+// commitControl sends a two-phase commit query for the given height to the chain apps in parallel.
+// It returns the errors of the failed chain apps by chain ID.
+func (mux *CometMux) commitControl(ctx context.Context, path string, height int64, ids []ChainAppIdentifier) map[string]error {
+	type controlResponse struct {
+		chainID string
+		err     error
+	}
+	chanResp := make(chan controlResponse, len(ids))
+	wg := sync.WaitGroup{}
+	wg.Add(len(ids))
+
+	for _, id := range ids {
+		hdlr := mux.clients[id]
+		go func() {
+			defer wg.Done()
+			appHeight := hdlr.appHeight(height)
+			query := abcitypes.RequestQuery{
+				Path:    path,
+				ChainId: hdlr.ChainID,
+				Height:  appHeight,
+				Data:    binary.BigEndian.AppendUint64(nil, uint64(appHeight)),
+			}
+			resp, err := hdlr.consensus().Query(ctx, &query)
+			if err == nil && resp.IsErr() {
+				err = fmt.Errorf("code %d: %s", resp.Code, resp.Log)
+			}
+			chanResp <- controlResponse{chainID: hdlr.ChainID, err: err}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(chanResp)
+	}()
+
+	failed := map[string]error{}
+	for resp := range chanResp {
+		if resp.err != nil {
+			mux.log.Error("two-phase commit call failed", "path", path, "height", height, "chain-id", resp.chainID, "error", resp.err)
+			failed[resp.chainID] = resp.err
+		}
+	}
+	return failed
+}
+
+// prepareCommit runs the prepare phase on all chain apps. If any app cannot commit the
+// height, the prepared apps are rolled back and nothing is committed.
+func (mux *CometMux) prepareCommit(ctx context.Context, height int64) error {
+	ids := mux.committingApps()
+	failed := mux.commitControl(ctx, QueryPathPrepareCommit, height, ids)
+	if len(failed) == 0 {
+		return nil
+	}
+
+	rollbackFailed := mux.commitControl(ctx, QueryPathRollback, height, ids)
+	chainIDs := mapKeys(failed)
+	sort.Strings(chainIDs)
+	if len(rollbackFailed) > 0 {
+		rollbackIDs := mapKeys(rollbackFailed)
+		sort.Strings(rollbackIDs)
+		return fmt.Errorf("prepare of height %d failed for %v, rollback failed for %v", height, chainIDs, rollbackIDs)
+	}
+	return fmt.Errorf("prepare of height %d failed for %v, all chain apps rolled back", height, chainIDs)
+}
+
+// rollbackCommit rolls all chain apps back after a partial commit and records the outcome
+func (mux *CometMux) rollbackCommit(ctx context.Context, partial *PartialCommitError) {
+	ids := mux.committingApps()
+	partial.RollbackFailed = mux.commitControl(ctx, QueryPathRollback, partial.Height, ids)
+	for _, id := range ids {
+		chainID := mux.clients[id].ChainID
+		if _, failed := partial.RollbackFailed[chainID]; !failed {
+			partial.RolledBack = append(partial.RolledBack, chainID)
+		}
+	}
+}
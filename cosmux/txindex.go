@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	comettypes "github.com/cometbft/cometbft/types"
+)
+
+// QueryPathTxHash is the ABCI query path to look up a routed transaction by its
+// outer (Megablocks) or inner (chain app) hash. The hash is passed as query data.
+const QueryPathTxHash = "/megablocks/tx_hash"
+
+// TxHashRecord maps the hash of a Megablocks transaction to the hash seen by the chain app
+type TxHashRecord struct {
+	OuterHash string `json:"outer_hash"`
+	InnerHash string `json:"inner_hash"`
+	ChainID   string `json:"chain_id"`
+	Height    int64  `json:"height"`
+	Index     int    `json:"index"`
+}
+
+// TxHashIndex stores the hash mapping of all transactions routed by the multiplexer
+type TxHashIndex struct {
+	db      dbm.DB
+	pending []indexEntry
+}
+
+type indexEntry struct {
+	outer, inner []byte
+	record       TxHashRecord
+}
+
+// NewTxHashIndex creates an index on the given database
+func NewTxHashIndex(db dbm.DB) *TxHashIndex {
+	return &TxHashIndex{db: db}
+}
+
+func outerKey(hash []byte) []byte {
+	return []byte(fmt.Sprintf("outer:%X", hash))
+}
+
+func innerPrefix(hash []byte) []byte {
+	return []byte(fmt.Sprintf("inner:%X:", hash))
+}
+
+// Add records the hashes of a transaction finalized at the given height.
+// Records are persisted on Flush.
+func (idx *TxHashIndex) Add(tx []byte, chainID string, height int64, index int) {
+	outer := comettypes.Tx(tx).Hash()
+	inner := comettypes.Tx(StripHeader(tx)).Hash()
+	idx.pending = append(idx.pending, indexEntry{
+		outer: outer,
+		inner: inner,
+		record: TxHashRecord{
+			OuterHash: fmt.Sprintf("%X", outer),
+			InnerHash: fmt.Sprintf("%X", inner),
+			ChainID:   chainID,
+			Height:    height,
+			Index:     index,
+		},
+	})
+}
+
+// Reset drops all records not yet persisted
+func (idx *TxHashIndex) Reset() {
+	idx.pending = nil
+}
+
+// Flush persists the records of the last finalized block
+func (idx *TxHashIndex) Flush() error {
+	batch := idx.db.NewBatch()
+	defer batch.Close()
+
+	for _, entry := range idx.pending {
+		value, err := json.Marshal(entry.record)
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(outerKey(entry.outer), value); err != nil {
+			return err
+		}
+		// the same inner tx may be routed to several chain apps
+		if err := batch.Set(append(innerPrefix(entry.inner), entry.record.OuterHash...), value); err != nil {
+			return err
+		}
+	}
+	idx.pending = nil
+	return batch.WriteSync()
+}
+
+// Lookup returns all records matching the given outer or inner hash
+func (idx *TxHashIndex) Lookup(hash []byte) ([]TxHashRecord, error) {
+	records := []TxHashRecord{}
+	value, err := idx.db.Get(outerKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
+		record := TxHashRecord{}
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	it, err := dbm.IteratePrefix(idx.db, innerPrefix(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		record := TxHashRecord{}
+		if err := json.Unmarshal(it.Value(), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, it.Error()
+}
+
+// Query handles queries on QueryPathTxHash
+func (idx *TxHashIndex) Query(req *abcitypes.RequestQuery) *abcitypes.ResponseQuery {
+	records, err := idx.Lookup(req.Data)
+	if err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	if len(records) == 0 {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: "tx hash not found"}
+	}
+	value, err := json.Marshal(records)
+	if err != nil {
+		return &abcitypes.ResponseQuery{Code: CodeQueryFailed, Codespace: MegablocksCodespace, Log: err.Error()}
+	}
+	return &abcitypes.ResponseQuery{Key: req.Data, Value: value, Height: records[0].Height}
+}
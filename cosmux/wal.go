@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	dbm "github.com/cometbft/cometbft-db"
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// WAL is the write-ahead log of the multiplexer. It records the last finalized height with the
+// request, the responses of all chain apps and which chain apps committed it, so an interrupted
+// height can be finished after a crash.
+type WAL struct {
+	db dbm.DB
+}
+
+// WALRecord is the logged progress of a height
+type WALRecord struct {
+	Height        int64
+	Request       *abcitypes.RequestFinalizeBlock
+	PrevAppHashes map[ChainAppIdentifier][]byte
+	Responses     map[ChainAppIdentifier]FinalizeResponse
+	Committed     map[ChainAppIdentifier]bool
+}
+
+var (
+	walHeightKey  = []byte("wal:height")
+	walRequestKey = []byte("wal:request")
+)
+
+func walAppKey(kind string, id ChainAppIdentifier) []byte {
+	return append([]byte("wal:"+kind+":"), id[:]...)
+}
+
+// NewWAL creates a write-ahead log on the given database
+func NewWAL(db dbm.DB) *WAL {
+	return &WAL{db: db}
+}
+
+// Finalize replaces the log by the finalized height and the responses of all chain apps
+func (w *WAL) Finalize(req *abcitypes.RequestFinalizeBlock, prevAppHashes map[ChainAppIdentifier][]byte, responses []FinalizeResponse) error {
+	batch := w.db.NewBatch()
+	defer batch.Close()
+
+	// drop the entries of the previous height
+	it, err := w.db.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	for ; it.Valid(); it.Next() {
+		if err := batch.Delete(it.Key()); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	request, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	entries := map[string][]byte{
+		string(walHeightKey):  binary.BigEndian.AppendUint64(nil, uint64(req.Height)),
+		string(walRequestKey): request,
+	}
+	for id, hash := range prevAppHashes {
+		entries[string(walAppKey("prev", id))] = hash
+	}
+	for _, resp := range responses {
+		response, err := resp.Response.Marshal()
+		if err != nil {
+			return err
+		}
+		slots, err := json.Marshal(resp.Slots)
+		if err != nil {
+			return err
+		}
+		entries[string(walAppKey("response", resp.HandlerID))] = response
+		entries[string(walAppKey("slots", resp.HandlerID))] = slots
+	}
+	for key, value := range entries {
+		if err := batch.Set([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return batch.WriteSync()
+}
+
+// Committed records that a chain app committed the logged height
+func (w *WAL) Committed(id ChainAppIdentifier) error {
+	return w.db.SetSync(walAppKey("committed", id), []byte{1})
+}
+
+// Load returns the logged height, nil if the log is empty
+func (w *WAL) Load() (*WALRecord, error) {
+	height, err := w.db.Get(walHeightKey)
+	if err != nil || height == nil {
+		return nil, err
+	}
+	record := &WALRecord{
+		Height:        int64(binary.BigEndian.Uint64(height)),
+		Request:       &abcitypes.RequestFinalizeBlock{},
+		PrevAppHashes: map[ChainAppIdentifier][]byte{},
+		Responses:     map[ChainAppIdentifier]FinalizeResponse{},
+		Committed:     map[ChainAppIdentifier]bool{},
+	}
+	request, err := w.db.Get(walRequestKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := record.Request.Unmarshal(request); err != nil {
+		return nil, fmt.Errorf("invalid request in WAL: %v", err)
+	}
+
+	it, err := dbm.IteratePrefix(w.db, []byte("wal:"))
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		var kind string
+		var id ChainAppIdentifier
+		if n := len(key) - len(id); n > 4 && key[n-1] == ':' {
+			kind = string(key[4 : n-1])
+			copy(id[:], key[n:])
+		}
+		switch kind {
+		case "prev":
+			record.PrevAppHashes[id] = value
+		case "committed":
+			record.Committed[id] = true
+		case "response":
+			resp := record.Responses[id]
+			resp.HandlerID = id
+			resp.Response = &abcitypes.ResponseFinalizeBlock{}
+			if err := resp.Response.Unmarshal(value); err != nil {
+				return nil, fmt.Errorf("invalid response in WAL: %v", err)
+			}
+			record.Responses[id] = resp
+		case "slots":
+			resp := record.Responses[id]
+			resp.HandlerID = id
+			if err := json.Unmarshal(value, &resp.Slots); err != nil {
+				return nil, fmt.Errorf("invalid slots in WAL: %v", err)
+			}
+			record.Responses[id] = resp
+		}
+	}
+	return record, nil
+}
+
+// SetWAL enables the write-ahead log
+func (mux *CometMux) SetWAL(wal *WAL) {
+	mux.wal = wal
+}
+
+// Recover finishes a height logged in the WAL which was committed by some chain apps only.
+// Chain apps which did not commit it are executed again and committed, so all chain apps are
+// at the same height before CometBFT starts its handshake. The tx hash index of the height is
+// written again. A height not committed by any chain app is left to the handshake.
+func (mux *CometMux) Recover(ctx context.Context) error {
+	if mux.wal == nil {
+		return nil
+	}
+	record, err := mux.wal.Load()
+	if err != nil || record == nil {
+		return err
+	}
+	if len(record.Committed) == 0 {
+		mux.log.Info("Height in WAL not committed by any chain app, left to the handshake", "height", record.Height)
+		return nil
+	}
+
+	redo := map[ChainAppIdentifier]bool{}
+	for id, hdlr := range mux.clients {
+		if _, executed := record.Responses[id]; record.Committed[id] || !executed {
+			continue
+		}
+		info, err := hdlr.query().Info(ctx, &abcitypes.RequestInfo{})
+		if err != nil {
+			return fmt.Errorf("error getting info of '%s': %v", hdlr.ChainID, err)
+		}
+		switch height := hdlr.lastHeight(info); {
+		case height >= record.Height:
+			// committed, but not logged before the crash
+		case height == record.Height-1:
+			redo[id] = true
+		default:
+			return fmt.Errorf("chain app '%s' at height %d cannot be recovered from WAL at height %d",
+				hdlr.ChainID, height, record.Height)
+		}
+	}
+
+	// skipped sparse chain apps keep their previous app hash
+	appHashes := map[ChainAppIdentifier][]byte{}
+	for id, hash := range record.PrevAppHashes {
+		appHashes[id] = hash
+	}
+	for id, resp := range record.Responses {
+		appHashes[id] = resp.Response.AppHash
+	}
+	if len(redo) > 0 {
+		mux.log.Info("Recovering height from WAL", "height", record.Height, "#apps", len(redo))
+		if err := mux.redoHeight(ctx, record, redo); err != nil {
+			return err
+		}
+		for id := range redo {
+			hdlr := mux.clients[id]
+			if _, err := hdlr.consensus().Commit(ctx, &abcitypes.RequestCommit{}); err != nil {
+				return fmt.Errorf("error committing '%s' at height %d: %v", hdlr.ChainID, record.Height, err)
+			}
+			if err := mux.wal.Committed(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	// pause changes of the logged height may not have been recorded before the crash
+	if _, changes := mux.applyControlTxs(record.Height, record.Request.Txs); len(changes) > 0 {
+		if err := mux.pauses.Record(changes); err != nil {
+			return fmt.Errorf("error recording pause changes at height %d: %v", record.Height, err)
+		}
+	}
+
+	mux.finalizedHeight = record.Height
+	mux.stateMtx.Lock()
+	mux.appHashes = appHashes
+	mux.stateMtx.Unlock()
+	mux.committedHeight.Store(record.Height)
+	// the tx hash index and app hashes of the logged height may not have been written before the crash
+	mux.indexTxs(record.Request)
+	mux.storeFinalized()
+	return nil
+}
+
+// redoHeight executes the logged height again on the given chain apps. Results of the other
+// chain apps are taken from the log, so conditional transactions see the same dependencies.
+func (mux *CometMux) redoHeight(ctx context.Context, record *WALRecord, redo map[ChainAppIdentifier]bool) error {
+	req := record.Request
+	txResults := make([]*abcitypes.ExecTxResult, len(req.Txs))
+	for id, resp := range record.Responses {
+		if !redo[id] && mux.clients[id] != nil {
+			mux.placeTxResults(resp, txResults)
+		}
+	}
+
+	// sibling app hashes refer to the previous height
+	mux.stateMtx.Lock()
+	mux.appHashes = record.PrevAppHashes
+	mux.stateMtx.Unlock()
+
+	results, err := mux.finalizeLagging(ctx, req, redo, txResults)
+	if err != nil {
+		return err
+	}
+	for _, resp := range results {
+		if logged, exists := record.Responses[resp.HandlerID]; exists &&
+			string(logged.Response.AppHash) != string(resp.Response.AppHash) {
+			mux.log.Error("App hash of re-executed height differs from WAL", "chain-id", mux.clients[resp.HandlerID].ChainID,
+				"height", req.Height, "logged", fmt.Sprintf("%X", logged.Response.AppHash),
+				"got", fmt.Sprintf("%X", resp.Response.AppHash))
+		}
+	}
+	return nil
+}